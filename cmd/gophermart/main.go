@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"os"
 	"time"
@@ -14,25 +15,64 @@ import (
 
 	"github.com/kazauwa/gophermart/internal/gophermart"
 	"github.com/kazauwa/gophermart/internal/storage"
+	"github.com/kazauwa/gophermart/internal/tracing"
 )
 
-func parseFlags(cfg *gophermart.Config) {
-	address := flag.String("a", "localhost:8080", "bind address")
-	databaseURI := flag.String("d", "postgres://127.0.0.1:5432/postgres", "database DSN")
-	accrualAddress := flag.String("r", "http://localhost:9090", "accrual system address")
-	cookieSecret := flag.String("s", "", "secret for encrypting session")
-	pollInterval := flag.Duration("p", time.Second*2, "poll interval")
+const (
+	exitOK = iota
+	exitFailure
+	exitShutdownTimeout
+)
+
+type cliFlags struct {
+	configFile     string
+	address        string
+	databaseURI    string
+	accrualAddress string
+	cookieSecret   string
+	pollInterval   time.Duration
+	set            map[string]bool
+}
+
+func parseFlags(defaults *gophermart.Config) *cliFlags {
+	flags := &cliFlags{set: make(map[string]bool)}
+	flag.StringVar(&flags.configFile, "c", "", "path to YAML config file")
+	flag.StringVar(&flags.address, "a", defaults.RunAddr, "bind address")
+	flag.StringVar(&flags.databaseURI, "d", defaults.DatabaseURI, "database DSN")
+	flag.StringVar(&flags.accrualAddress, "r", defaults.AccrualSystemAddr, "accrual system address")
+	flag.StringVar(&flags.cookieSecret, "s", defaults.CookieSecret, "secret for encrypting session")
+	flag.DurationVar(&flags.pollInterval, "p", defaults.PollInterval, "poll interval")
 
 	flag.Parse()
-	cfg.RunAddr = *address
-	cfg.DatabaseURI = *databaseURI
-	cfg.AccrualSystemAddr = *accrualAddress
-	cfg.CookieSecret = *cookieSecret
-	cfg.PollInterval = *pollInterval
+	flag.Visit(func(f *flag.Flag) {
+		flags.set[f.Name] = true
+	})
+	return flags
+}
+
+// apply overrides cfg with the flags given explicitly on the command line, so
+// that flags take precedence over both the config file and env.
+func (f *cliFlags) apply(cfg *gophermart.Config) {
+	if f.set["a"] {
+		cfg.RunAddr = f.address
+	}
+	if f.set["d"] {
+		cfg.DatabaseURI = f.databaseURI
+	}
+	if f.set["r"] {
+		cfg.AccrualSystemAddr = f.accrualAddress
+	}
+	if f.set["s"] {
+		cfg.CookieSecret = f.cookieSecret
+	}
+	if f.set["p"] {
+		cfg.PollInterval = f.pollInterval
+	}
 }
 
 func main() {
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	zerolog.DefaultContextLogger = &log.Logger
 	if gin.IsDebugging() {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	}
@@ -40,21 +80,60 @@ func main() {
 
 	decimal.MarshalJSONWithoutQuotes = true
 
-	parseFlags(cfg)
+	flags := parseFlags(cfg)
+	if flags.configFile != "" {
+		if err := cfg.LoadFile(flags.configFile); err != nil {
+			log.Fatal().Err(err).Caller().Msg("cannot load config file")
+		}
+	}
+
 	err := env.Parse(cfg)
 	if err != nil {
 		log.Fatal().Err(err).Caller().Msg("cannot parse env")
 		os.Exit(1)
 	}
+	flags.apply(cfg)
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatal().Err(err).Caller().Msg("Cannot start service")
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	shutdownTracing, err := tracing.Setup(ctx, cfg.TracingExporter)
+	if err != nil {
+		log.Fatal().Err(err).Caller().Msg("Cannot start service")
+	}
+
 	err = storage.NewPostgres(ctx, cfg.DatabaseURI)
 	if err != nil {
 		log.Fatal().Err(err).Caller().Msg("Cannot start service")
 	}
 
-	app := gophermart.GetGophermartApp(cfg)
-	app.Serve()
+	app, err := gophermart.GetGophermartApp(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Caller().Msg("Cannot start service")
+	}
+	err = app.Serve()
+	if err := shutdownTracing(context.Background()); err != nil {
+		log.Err(err).Caller().Msg("cannot flush traces")
+	}
+	cancel()
+	os.Exit(exitCode(err))
+}
+
+// exitCode tells a clean stop apart from a failure and from a shutdown that
+// had to abort unfinished work.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, gophermart.ErrShutdownTimeout):
+		log.Error().Err(err).Msg("Shutdown was not graceful")
+		return exitShutdownTimeout
+	default:
+		log.Error().Err(err).Msg("Service failed")
+		return exitFailure
+	}
 }
@@ -0,0 +1,244 @@
+package gophermart
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/shopspring/decimal"
+
+	"github.com/kazauwa/gophermart/internal/middlewares"
+	"github.com/kazauwa/gophermart/internal/models"
+)
+
+const (
+	defaultAdminSearchLimit = 50
+	maxAdminSearchLimit     = 200
+)
+
+type adminUserView struct {
+	ID      int             `json:"id"`
+	Login   string          `json:"login"`
+	Role    models.Role     `json:"role"`
+	Blocked bool            `json:"blocked"`
+	Balance decimal.Decimal `json:"balance"`
+}
+
+func newAdminUserView(user *models.User) *adminUserView {
+	return &adminUserView{
+		ID:      user.ID,
+		Login:   user.Login,
+		Role:    user.Role,
+		Blocked: user.Blocked,
+		Balance: user.Balance,
+	}
+}
+
+func (g *Gophermart) createAdminRouter(router *gin.Engine) {
+	adminAPI := router.Group(
+		"/api/admin",
+		middlewares.AuthRequired,
+		middlewares.RequireRole(models.RoleSupport, models.RoleAdmin),
+	)
+
+	viewUsers := middlewares.RequirePermission(models.PermissionViewUsers)
+	blockUsers := middlewares.RequirePermission(models.PermissionBlockUsers)
+	adjustBalance := middlewares.RequirePermission(models.PermissionAdjustBalance)
+
+	adminAPI.GET("/users", viewUsers, g.adminSearchUsers)
+	adminAPI.GET("/users/:id", viewUsers, g.adminGetUser)
+	adminAPI.POST("/users/:id/block", blockUsers, g.adminBlockUser)
+	adminAPI.POST("/users/:id/unblock", blockUsers, g.adminUnblockUser)
+	adminAPI.POST("/users/:id/adjustments", adjustBalance, g.adminAdjustBalance)
+
+	managePartners := middlewares.RequirePermission(models.PermissionManagePartner)
+	adminAPI.POST("/partners", managePartners, g.adminCreatePartner)
+	adminAPI.GET("/partners/:id/keys", managePartners, g.adminListAPIKeys)
+	adminAPI.POST("/partners/:id/keys", managePartners, g.adminIssueAPIKey)
+	adminAPI.DELETE("/partners/:id/keys/:key_id", managePartners, g.adminRevokeAPIKey)
+
+	viewAudit := middlewares.RequirePermission(models.PermissionViewAudit)
+	adminAPI.GET("/audit", viewAudit, g.adminListAuditEvents)
+}
+
+func currentUserFromContext(c *gin.Context) (*models.User, bool) {
+	userValue, _ := c.Get("user")
+	currentUser, ok := userValue.(*models.User)
+	if !ok {
+		log.Ctx(c).Error().Caller().Msg("malformed user in session")
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}
+	return currentUser, ok
+}
+
+func targetUserFromParam(c *gin.Context) (*models.User, bool) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	user := models.NewUser()
+	err = user.GetByID(c.Request.Context(), userID)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, false
+
+	case err != nil:
+		log.Ctx(c).Err(err).Caller().Msg("failed to fetch user")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, false
+	}
+	return user, true
+}
+
+func (g *Gophermart) adminSearchUsers(c *gin.Context) {
+	limit := defaultAdminSearchLimit
+	if rawLimit := c.Query("limit"); rawLimit != "" {
+		parsed, err := strconv.Atoi(rawLimit)
+		if err != nil || parsed <= 0 || parsed > maxAdminSearchLimit {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = parsed
+	}
+
+	users, err := models.SearchUsers(c.Request.Context(), c.Query("login"), limit)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to search users")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]*adminUserView, 0, len(users))
+	for _, user := range users {
+		response = append(response, newAdminUserView(user))
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (g *Gophermart) adminGetUser(c *gin.Context) {
+	ctx := c.Request.Context()
+	user, ok := targetUserFromParam(c)
+	if !ok {
+		return
+	}
+
+	totalWithdrawn, err := user.TotalWithdrawn(ctx)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("cannot fetch withdrawal sum from db")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	orders, err := user.GetOrders(ctx)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("cannot fetch user orders")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	withdrawals, err := user.GetWithdrawalHistory(ctx)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("cannot fetch withdrawals from db")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user":        newAdminUserView(user),
+		"withdrawn":   totalWithdrawn.Decimal,
+		"orders":      orders,
+		"withdrawals": withdrawals,
+	})
+}
+
+func (g *Gophermart) adminBlockUser(c *gin.Context) {
+	g.adminSetBlocked(c, true)
+}
+
+func (g *Gophermart) adminUnblockUser(c *gin.Context) {
+	g.adminSetBlocked(c, false)
+}
+
+func (g *Gophermart) adminSetBlocked(c *gin.Context, blocked bool) {
+	currentUser, ok := currentUserFromContext(c)
+	if !ok {
+		return
+	}
+
+	user, ok := targetUserFromParam(c)
+	if !ok {
+		return
+	}
+
+	if user.ID == currentUser.ID {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "cannot block yourself"})
+		return
+	}
+
+	if !currentUser.Outranks(user) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "cannot block a user with an equal or higher role"})
+		return
+	}
+
+	if err := user.SetBlocked(c.Request.Context(), blocked, currentUser.ID); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to update user block status")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, newAdminUserView(user))
+}
+
+type adjustBalanceRequest struct {
+	Amount decimal.Decimal `json:"amount"`
+	Reason string          `json:"reason" binding:"required,min=3,max=1024"`
+}
+
+func (g *Gophermart) adminAdjustBalance(c *gin.Context) {
+	currentUser, ok := currentUserFromContext(c)
+	if !ok {
+		return
+	}
+
+	var jsonRequest adjustBalanceRequest
+
+	if err := c.Bind(&jsonRequest); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if jsonRequest.Amount.IsZero() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "amount must not be zero"})
+		return
+	}
+
+	user, ok := targetUserFromParam(c)
+	if !ok {
+		return
+	}
+
+	adjustment, err := user.AdjustBalance(
+		c.Request.Context(),
+		jsonRequest.Amount,
+		jsonRequest.Reason,
+		currentUser.ID,
+	)
+	switch {
+	case errors.Is(err, models.ErrNegativeBalance):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+
+	case err != nil:
+		log.Ctx(c).Err(err).Caller().Msg("failed to adjust balance")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, adjustment)
+}
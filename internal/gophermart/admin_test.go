@@ -0,0 +1,69 @@
+package gophermart
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/kazauwa/gophermart/internal/models"
+	"github.com/kazauwa/gophermart/internal/storage"
+	"github.com/kazauwa/gophermart/internal/storage/storagetest"
+)
+
+// newRoleUser inserts a user with the given role.
+func newRoleUser(t *testing.T, role models.Role) *models.User {
+	t.Helper()
+	ctx := context.Background()
+
+	user := models.NewUser()
+	user.Login = role + "_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	user.SetPasswordHash("hash")
+	if err := user.Insert(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := storage.GetDB().Pool.Exec(ctx, "UPDATE users SET role = $1 WHERE id = $2", role, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	user.Role = role
+	return user
+}
+
+func TestAdminBlockRequiresHigherRole(t *testing.T) {
+	storagetest.Require(t)
+	gin.SetMode(gin.TestMode)
+	g := &Gophermart{cfg: NewConfig()}
+
+	support := newRoleUser(t, models.RoleSupport)
+	tests := []struct {
+		name       string
+		target     *models.User
+		wantStatus int
+	}{
+		{name: "admin", target: newRoleUser(t, models.RoleAdmin), wantStatus: http.StatusForbidden},
+		{name: "support", target: newRoleUser(t, models.RoleSupport), wantStatus: http.StatusForbidden},
+		{name: "user", target: newRoleUser(t, models.RoleUser), wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.POST("/api/admin/users/:id/block", func(c *gin.Context) {
+				c.Set("user", support)
+			}, g.adminBlockUser)
+
+			target := "/api/admin/users/" + strconv.Itoa(tt.target.ID) + "/block"
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, target, nil))
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d: %s", recorder.Code, tt.wantStatus, recorder.Body)
+			}
+		})
+	}
+}
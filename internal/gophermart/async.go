@@ -8,12 +8,24 @@ import (
 	"golang.org/x/sync/errgroup"
 
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 
+	"github.com/kazauwa/gophermart/internal/metrics"
 	"github.com/kazauwa/gophermart/internal/models"
+	"github.com/kazauwa/gophermart/internal/tracing"
 	"github.com/kazauwa/gophermart/internal/utils"
 )
 
-func (g *Gophermart) ScheduleTasks(ctx context.Context) error {
+// ScheduleTasks polls the accrual system until ctx is done. Cancelling ctx
+// lets the batch in progress stop after its current order; workCtx is used
+// for the database and accrual calls and aborts them when cancelled.
+//
+// The poller does not lease or lock the orders it reads, so stopping it leaves
+// nothing to release: orders it did not get to keep their status and are
+// picked up again by the next run.
+func (g *Gophermart) ScheduleTasks(ctx, workCtx context.Context) error {
+	g.markPollerTick()
 	pollTicker := time.NewTicker(g.cfg.PollInterval)
 	defer pollTicker.Stop()
 	errg, innerCtx := errgroup.WithContext(ctx)
@@ -21,9 +33,10 @@ func (g *Gophermart) ScheduleTasks(ctx context.Context) error {
 	events := make(chan struct{})
 	errg.Go(func() error {
 		for range events {
-			if err := g.updateUserBalance(innerCtx); err != nil {
+			if err := g.updateUserBalance(workCtx, innerCtx.Done()); err != nil {
 				return err
 			}
+			g.markPollerTick()
 		}
 		return nil
 	})
@@ -43,35 +56,56 @@ func (g *Gophermart) ScheduleTasks(ctx context.Context) error {
 	}
 }
 
-func (g *Gophermart) updateUserBalance(ctx context.Context) error {
+func (g *Gophermart) updateUserBalance(ctx context.Context, stop <-chan struct{}) error {
+	ctx, span := tracing.Tracer().Start(ctx, "poller.tick")
+	defer span.End()
+	logger := log.With().Str("component", "poller").Logger()
+	ctx = logger.WithContext(ctx)
+
 	orders, err := models.GetUnprocessedOrders(ctx)
 	if err != nil {
+		span.RecordError(err)
 		return err
 	}
 
+	metrics.SetPollerBacklog(len(orders))
+	span.SetAttributes(attribute.Int("poller.backlog", len(orders)))
 	if len(orders) == 0 {
 		return nil
 	}
 
 	for _, order := range orders {
-		orderInfo, err := utils.GetOrderInfo(ctx, g.cfg.AccrualSystemAddr, g.client, order.ID)
+		select {
+		case <-stop:
+			log.Ctx(ctx).Info().Msg("poller stopped, leaving remaining orders for the next run")
+			return nil
+		default:
+		}
+
+		orderInfo, err := g.fetchOrderInfo(ctx, order.ID)
 		var rateLimitedError *utils.RateLimitedError
 		var orderDoesNotExistError *utils.OrderDoesNotExistError
 
 		switch {
 		case errors.As(err, &rateLimitedError):
-			time.Sleep(time.Duration(rateLimitedError.RetryAfter))
+			timer := time.NewTimer(rateLimitedError.RetryAfter)
+			select {
+			case <-timer.C:
+			case <-stop:
+				timer.Stop()
+			}
+			continue
 		case errors.As(err, &orderDoesNotExistError):
 			continue
 		case err != nil:
-			log.Err(err).Caller().Msg("error accessing accrual system")
+			log.Ctx(ctx).Err(err).Caller().Msg("error accessing accrual system")
 			return err
 		}
 
 		switch orderInfo.Status {
 		case utils.Invalid:
-			if err := order.SetFailed(ctx, order.ID); err != nil {
-				log.Err(err).Caller().Msg("error processing order")
+			if err := order.SetFailed(ctx, order.ID, models.SourcePoller); err != nil {
+				log.Ctx(ctx).Err(err).Caller().Msg("error processing order")
 				return err
 			}
 
@@ -79,16 +113,44 @@ func (g *Gophermart) updateUserBalance(ctx context.Context) error {
 			user := models.NewUser()
 			err := user.GetByID(ctx, order.UserID)
 			if err != nil {
-				log.Err(err).Caller().Msg("error fetching user")
+				log.Ctx(ctx).Err(err).Caller().Msg("error fetching user")
+				return err
+			}
+
+			if err := user.Deposit(ctx, order.ID, orderInfo.Accrual, models.SourcePoller); err != nil {
+				log.Ctx(ctx).Err(err).Caller().Msg("error depositing points to user balance")
 				return err
 			}
+			metrics.AddDeposit(orderInfo.Accrual)
+
+		case utils.Processing:
+			if order.Status == models.Processing {
+				continue
+			}
 
-			if err := user.Deposit(ctx, order.ID, orderInfo.Accrual); err != nil {
-				log.Err(err).Caller().Msg("error depositing points to user balance")
+			err := order.SetStatus(ctx, order.ID, models.Processing, models.SourcePoller)
+			if err != nil {
+				log.Ctx(ctx).Err(err).Caller().Msg("error processing order")
 				return err
 			}
+
 		default:
 		}
 	}
 	return nil
 }
+
+func (g *Gophermart) fetchOrderInfo(ctx context.Context, orderID utils.OrderNumber) (*utils.OrderInfo, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "accrual.get_order")
+	defer span.End()
+	span.SetAttributes(attribute.String("order.number", orderID.String()))
+
+	orderInfo, err := utils.GetOrderInfo(ctx, g.cfg.AccrualSystemAddr, g.client, orderID)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(attribute.String("order.status", orderInfo.Status))
+	return orderInfo, nil
+}
@@ -0,0 +1,83 @@
+package gophermart
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	"github.com/kazauwa/gophermart/internal/models"
+)
+
+// recordAudit stores a standalone audit event. A failure to record is logged
+// but does not fail the request that triggered it.
+func recordAudit(ctx context.Context, event *models.AuditEvent) {
+	if err := event.Record(ctx); err != nil {
+		log.Ctx(ctx).Err(err).Caller().Str("action", event.Action).Msg("failed to record audit event")
+	}
+}
+
+// actorID returns the id of the authenticated user, or 0 if there is none.
+func actorID(c *gin.Context) int {
+	userValue, _ := c.Get("user")
+	if user, ok := userValue.(*models.User); ok {
+		return user.ID
+	}
+	return 0
+}
+
+func parseTimeQuery(c *gin.Context, name string) (time.Time, bool) {
+	raw := c.Query(name)
+	if raw == "" {
+		return time.Time{}, true
+	}
+
+	parsed, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid " + name})
+		return time.Time{}, false
+	}
+	return parsed, true
+}
+
+func (g *Gophermart) adminListAuditEvents(c *gin.Context) {
+	var userID int
+	if rawUserID := c.Query("user_id"); rawUserID != "" {
+		parsed, err := strconv.Atoi(rawUserID)
+		if err != nil || parsed <= 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid user_id"})
+			return
+		}
+		userID = parsed
+	}
+
+	from, ok := parseTimeQuery(c, "from")
+	if !ok {
+		return
+	}
+	to, ok := parseTimeQuery(c, "to")
+	if !ok {
+		return
+	}
+
+	limit := defaultAdminSearchLimit
+	if rawLimit := c.Query("limit"); rawLimit != "" {
+		parsed, err := strconv.Atoi(rawLimit)
+		if err != nil || parsed <= 0 || parsed > maxAdminSearchLimit {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = parsed
+	}
+
+	events, err := models.GetAuditEvents(c.Request.Context(), userID, from, to, limit)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to fetch audit events")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, events)
+}
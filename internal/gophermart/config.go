@@ -1,24 +1,312 @@
 package gophermart
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alexedwards/argon2id"
+	"github.com/jackc/pgx/v4"
+	"github.com/shopspring/decimal"
+	"gopkg.in/yaml.v3"
+
+	"github.com/kazauwa/gophermart/internal/tracing"
+)
+
+const minCookieSecretLength = 32
 
 type ArgonParams struct {
-	Memory      uint32 `yaml:"memory"`
-	Iterations  uint32 `yaml:"iterations"`
-	Parallelism uint8  `yaml:"parallelism"`
-	SaltLength  uint32 `yaml:"salt_length"`
-	KeyLength   uint32 `yaml:"key_length"`
+	Memory      uint32 `yaml:"memory" env:"ARGON_MEMORY"`
+	Iterations  uint32 `yaml:"iterations" env:"ARGON_ITERATIONS"`
+	Parallelism uint8  `yaml:"parallelism" env:"ARGON_PARALLELISM"`
+	SaltLength  uint32 `yaml:"salt_length" env:"ARGON_SALT_LENGTH"`
+	KeyLength   uint32 `yaml:"key_length" env:"ARGON_KEY_LENGTH"`
+}
+
+func (p *ArgonParams) Params() *argon2id.Params {
+	return &argon2id.Params{
+		Memory:      p.Memory,
+		Iterations:  p.Iterations,
+		Parallelism: p.Parallelism,
+		SaltLength:  p.SaltLength,
+		KeyLength:   p.KeyLength,
+	}
 }
 
 type Config struct {
-	RunAddr           string        `yaml:"address" env:"RUN_ADDRESS"`
-	DatabaseURI       string        `yaml:"database_uri" env:"DATABASE_URI"`
-	AccrualSystemAddr string        `yaml:"accrual_address" env:"ACCRUAL_SYSTEM_ADDRESS"`
-	CookieSecret      string        `yaml:"cookie_secret" env:"COOKIE_SECRET"`
-	Argon             *ArgonParams  `yaml:"encryption"`
-	PollInterval      time.Duration `yaml:"poll_interval" env:"POLL_INTERVAL"`
+	RunAddr           string            `yaml:"address" env:"RUN_ADDRESS"`
+	MetricsAddr       string            `yaml:"metrics_address" env:"METRICS_ADDRESS"`
+	DatabaseURI       string            `yaml:"database_uri" env:"DATABASE_URI"`
+	AccrualSystemAddr string            `yaml:"accrual_address" env:"ACCRUAL_SYSTEM_ADDRESS"`
+	CookieSecret      string            `yaml:"cookie_secret" env:"COOKIE_SECRET"`
+	Argon             *ArgonParams      `yaml:"encryption"`
+	PollInterval      time.Duration     `yaml:"poll_interval" env:"POLL_INTERVAL"`
+	JWTKeys           map[string]string `yaml:"jwt_keys" env:"JWT_KEYS"`
+	JWTSigningKeyID   string            `yaml:"jwt_signing_key_id" env:"JWT_SIGNING_KEY_ID"`
+	AccessTokenTTL    time.Duration     `yaml:"access_token_ttl" env:"ACCESS_TOKEN_TTL"`
+	RefreshTokenTTL   time.Duration     `yaml:"refresh_token_ttl" env:"REFRESH_TOKEN_TTL"`
+	PasswordResetTTL  time.Duration     `yaml:"password_reset_ttl" env:"PASSWORD_RESET_TTL"`
+	SessionTTL        time.Duration     `yaml:"session_ttl" env:"SESSION_TTL"`
+	NotifierFile      string            `yaml:"notifier_file" env:"NOTIFIER_FILE"`
+	LoginLockout      *LockoutParams    `yaml:"login_lockout"`
+	TwoFactor         *TwoFactorParams  `yaml:"two_factor"`
+	OIDC              *OIDCParams       `yaml:"oidc"`
+	TracingExporter   string            `yaml:"tracing_exporter" env:"TRACING_EXPORTER"`
+	PollerStaleTicks  int               `yaml:"poller_stale_ticks" env:"POLLER_STALE_TICKS"`
+	ShutdownTimeout   time.Duration     `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+	TrustedProxies    []string          `yaml:"trusted_proxies" env:"TRUSTED_PROXIES" envSeparator:","`
+	ClientIPHeader    string            `yaml:"client_ip_header" env:"CLIENT_IP_HEADER"`
+	TLS               *TLSParams        `yaml:"tls"`
+}
+
+type TLSParams struct {
+	CertFile       string        `yaml:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile        string        `yaml:"key_file" env:"TLS_KEY_FILE"`
+	MinVersion     string        `yaml:"min_version" env:"TLS_MIN_VERSION"`
+	CipherSuites   []string      `yaml:"cipher_suites" env:"TLS_CIPHER_SUITES" envSeparator:","`
+	ClientCAFile   string        `yaml:"client_ca_file" env:"TLS_CLIENT_CA_FILE"`
+	ReloadInterval time.Duration `yaml:"reload_interval" env:"TLS_RELOAD_INTERVAL"`
+}
+
+func (p *TLSParams) Enabled() bool {
+	return p.CertFile != "" || p.KeyFile != ""
+}
+
+type OIDCParams struct {
+	Issuer        string   `yaml:"issuer" env:"OIDC_ISSUER"`
+	ClientID      string   `yaml:"client_id" env:"OIDC_CLIENT_ID"`
+	ClientSecret  string   `yaml:"client_secret" env:"OIDC_CLIENT_SECRET"`
+	RedirectURL   string   `yaml:"redirect_url" env:"OIDC_REDIRECT_URL"`
+	Scopes        []string `yaml:"scopes" env:"OIDC_SCOPES" envSeparator:","`
+	AutoProvision bool     `yaml:"auto_provision" env:"OIDC_AUTO_PROVISION"`
+}
+
+type TwoFactorParams struct {
+	Issuer            string          `yaml:"issuer" env:"TWO_FACTOR_ISSUER"`
+	ChallengeTTL      time.Duration   `yaml:"challenge_ttl" env:"TWO_FACTOR_CHALLENGE_TTL"`
+	MaxAttempts       int             `yaml:"max_attempts" env:"TWO_FACTOR_MAX_ATTEMPTS"`
+	WithdrawThreshold decimal.Decimal `yaml:"withdraw_threshold" env:"TWO_FACTOR_WITHDRAW_THRESHOLD"`
+}
+
+type LockoutParams struct {
+	MaxAttemptsPerLogin int           `yaml:"max_attempts_per_login" env:"LOGIN_MAX_ATTEMPTS_PER_LOGIN"`
+	MaxAttemptsPerIP    int           `yaml:"max_attempts_per_ip" env:"LOGIN_MAX_ATTEMPTS_PER_IP"`
+	BaseLockout         time.Duration `yaml:"base_lockout" env:"LOGIN_BASE_LOCKOUT"`
+	MaxLockout          time.Duration `yaml:"max_lockout" env:"LOGIN_MAX_LOCKOUT"`
 }
 
 func NewConfig() *Config {
-	return &Config{}
+	return &Config{
+		RunAddr:           "localhost:8080",
+		MetricsAddr:       "localhost:9464",
+		DatabaseURI:       "postgres://127.0.0.1:5432/postgres",
+		AccrualSystemAddr: "http://localhost:9090",
+		PollInterval:      2 * time.Second,
+		Argon: &ArgonParams{
+			Memory:      argon2id.DefaultParams.Memory,
+			Iterations:  argon2id.DefaultParams.Iterations,
+			Parallelism: argon2id.DefaultParams.Parallelism,
+			SaltLength:  argon2id.DefaultParams.SaltLength,
+			KeyLength:   argon2id.DefaultParams.KeyLength,
+		},
+		AccessTokenTTL:   15 * time.Minute,
+		RefreshTokenTTL:  30 * 24 * time.Hour,
+		PasswordResetTTL: time.Hour,
+		SessionTTL:       7 * 24 * time.Hour,
+		PollerStaleTicks: 3,
+		ShutdownTimeout:  30 * time.Second,
+		ClientIPHeader:   "X-Forwarded-For",
+		LoginLockout: &LockoutParams{
+			MaxAttemptsPerLogin: 5,
+			MaxAttemptsPerIP:    20,
+			BaseLockout:         30 * time.Second,
+			MaxLockout:          time.Hour,
+		},
+		TwoFactor: &TwoFactorParams{
+			Issuer:            "Gophermart",
+			ChallengeTTL:      5 * time.Minute,
+			MaxAttempts:       5,
+			WithdrawThreshold: decimal.NewFromInt(1000),
+		},
+		OIDC: &OIDCParams{
+			Scopes:        []string{"openid", "profile", "email"},
+			AutoProvision: true,
+		},
+		TLS: &TLSParams{
+			MinVersion:     "1.2",
+			ReloadInterval: 30 * time.Second,
+		},
+	}
+}
+
+// LoadFile fills the config from a YAML file. Keys the config does not know
+// about are rejected, so typos do not silently fall back to defaults.
+func (c *Config) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// ValidationError lists every problem found in the config.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid config: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate checks the config as a whole and reports all problems at once.
+func (c *Config) Validate() error {
+	var problems []string
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.RunAddr == "" {
+		addProblem("address must not be empty")
+	}
+	if c.MetricsAddr != "" && c.MetricsAddr == c.RunAddr {
+		addProblem("metrics_address must differ from address")
+	}
+	if _, err := pgx.ParseConfig(c.DatabaseURI); err != nil {
+		addProblem("database_uri is invalid: %v", err)
+	}
+	if err := validateURL(c.AccrualSystemAddr); err != nil {
+		addProblem("accrual_address is invalid: %v", err)
+	}
+	if len(c.CookieSecret) < minCookieSecretLength {
+		addProblem("cookie_secret must be at least %d characters long", minCookieSecretLength)
+	}
+	if c.PollInterval <= 0 {
+		addProblem("poll_interval must be positive")
+	}
+	if c.PollerStaleTicks <= 0 {
+		addProblem("poller_stale_ticks must be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		addProblem("shutdown_timeout must be positive")
+	}
+	for _, proxy := range c.TrustedProxies {
+		if !isValidProxy(proxy) {
+			addProblem("trusted_proxies entry %q is not an IP address or CIDR", proxy)
+		}
+	}
+	if len(c.TrustedProxies) > 0 && c.ClientIPHeader == "" {
+		addProblem("client_ip_header must not be empty when trusted_proxies are set")
+	}
+
+	// A section key without a value in YAML leaves the section nil.
+	if c.Argon == nil {
+		addProblem("encryption must not be empty")
+	} else if c.Argon.Memory == 0 || c.Argon.Iterations == 0 || c.Argon.Parallelism == 0 ||
+		c.Argon.SaltLength == 0 || c.Argon.KeyLength == 0 {
+		addProblem("encryption parameters must be positive")
+	}
+
+	if c.AccessTokenTTL <= 0 || c.RefreshTokenTTL <= 0 || c.PasswordResetTTL <= 0 || c.SessionTTL <= 0 {
+		addProblem("token and session TTLs must be positive")
+	}
+	if len(c.JWTKeys) > 0 {
+		if _, ok := c.JWTKeys[c.JWTSigningKeyID]; !ok {
+			addProblem("jwt_signing_key_id %q is not one of jwt_keys", c.JWTSigningKeyID)
+		}
+	}
+
+	if c.LoginLockout == nil {
+		addProblem("login_lockout must not be empty")
+	} else {
+		if c.LoginLockout.MaxAttemptsPerLogin <= 0 || c.LoginLockout.MaxAttemptsPerIP <= 0 {
+			addProblem("login_lockout attempts must be positive")
+		}
+		if c.LoginLockout.BaseLockout <= 0 || c.LoginLockout.MaxLockout < c.LoginLockout.BaseLockout {
+			addProblem("login_lockout durations must be positive and max_lockout not below base_lockout")
+		}
+	}
+
+	if c.TwoFactor == nil {
+		addProblem("two_factor must not be empty")
+	} else if c.TwoFactor.ChallengeTTL <= 0 || c.TwoFactor.MaxAttempts <= 0 {
+		addProblem("two_factor challenge_ttl and max_attempts must be positive")
+	}
+
+	if c.OIDC == nil {
+		addProblem("oidc must not be empty")
+	} else if c.OIDC.Issuer != "" {
+		if err := validateURL(c.OIDC.Issuer); err != nil {
+			addProblem("oidc issuer is invalid: %v", err)
+		}
+		if err := validateURL(c.OIDC.RedirectURL); err != nil {
+			addProblem("oidc redirect_url is invalid: %v", err)
+		}
+		if c.OIDC.ClientID == "" {
+			addProblem("oidc client_id must not be empty")
+		}
+	}
+
+	if c.TLS == nil {
+		addProblem("tls must not be empty")
+	} else if c.TLS.Enabled() {
+		if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+			addProblem("tls cert_file and key_file must be set together")
+		}
+		if _, ok := tlsVersions[c.TLS.MinVersion]; !ok {
+			addProblem("tls min_version must be 1.2 or 1.3")
+		}
+		if _, err := cipherSuiteIDs(c.TLS.CipherSuites); err != nil {
+			addProblem("tls cipher_suites: %v", err)
+		}
+		if c.TLS.ReloadInterval <= 0 {
+			addProblem("tls reload_interval must be positive")
+		}
+	} else if c.TLS.ClientCAFile != "" {
+		addProblem("tls client_ca_file requires cert_file and key_file")
+	}
+
+	switch c.TracingExporter {
+	case tracing.ExporterNone, tracing.ExporterStdout, tracing.ExporterOTLP:
+	default:
+		addProblem("tracing_exporter must be one of %q, %q", tracing.ExporterStdout, tracing.ExporterOTLP)
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func isValidProxy(proxy string) bool {
+	if strings.Contains(proxy, "/") {
+		_, _, err := net.ParseCIDR(proxy)
+		return err == nil
+	}
+	return net.ParseIP(proxy) != nil
+}
+
+func validateURL(raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https")
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("host must not be empty")
+	}
+	return nil
 }
@@ -0,0 +1,149 @@
+package gophermart
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	"github.com/kazauwa/gophermart/internal/models"
+)
+
+func (g *Gophermart) exportUserData(c *gin.Context) {
+	ctx := c.Request.Context()
+	currentUser, ok := currentUserFromContext(c)
+	if !ok {
+		return
+	}
+
+	orders, err := currentUser.GetOrders(ctx)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("cannot fetch user orders")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	orderDetails := make([]*models.OrderDetails, 0, len(orders))
+	for _, order := range orders {
+		history, err := order.GetStatusHistory(ctx)
+		if err != nil {
+			log.Ctx(c).Err(err).Caller().Msg("cannot fetch order status history")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		orderDetails = append(orderDetails, &models.OrderDetails{Order: order, History: history})
+	}
+
+	withdrawals, err := currentUser.GetWithdrawalHistory(ctx)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("cannot fetch withdrawals from db")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	balanceHistory, err := currentUser.GetBalanceHistory(ctx)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("cannot fetch balance history")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	userSessions, err := currentUser.GetActiveSessions(ctx)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("cannot fetch user sessions")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	c.Header(
+		"Content-Disposition",
+		fmt.Sprintf(`attachment; filename="gophermart-export-%s.json"`, now.Format("20060102")),
+	)
+	c.JSON(http.StatusOK, gin.H{
+		"exported_at": now.Format(time.RFC3339),
+		"profile": gin.H{
+			"login":        currentUser.Login,
+			"role":         currentUser.Role,
+			"totp_enabled": currentUser.TOTPEnabled,
+			"balance":      currentUser.Balance,
+		},
+		"orders":          orderDetails,
+		"withdrawals":     withdrawals,
+		"balance_history": balanceHistory,
+		"sessions":        userSessions,
+	})
+}
+
+// deleteUserRequest confirms the deletion with the password. Users without a
+// password leave it empty and log in through the identity provider right
+// before instead.
+type deleteUserRequest struct {
+	Password string `json:"password"`
+}
+
+func (g *Gophermart) deleteUser(c *gin.Context) {
+	currentUser, ok := currentUserFromContext(c)
+	if !ok {
+		return
+	}
+
+	var jsonRequest deleteUserRequest
+
+	if err := c.Bind(&jsonRequest); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if jsonRequest.Password == "" {
+		if !recentOIDCLogin(c, currentUser) {
+			c.AbortWithStatusJSON(
+				http.StatusUnauthorized,
+				gin.H{"error": "password or a recent identity provider login is required"},
+			)
+			return
+		}
+	} else {
+		ok, err := currentUser.CheckPassword(jsonRequest.Password)
+		if err != nil {
+			log.Ctx(c).Err(err).Caller().Msg("failed to check password")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+			return
+		}
+	}
+
+	unusablePassword, err := randomState()
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to generate password")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err := currentUser.SetPassword(unusablePassword, g.cfg.Argon.Params()); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err := currentUser.Anonymize(c.Request.Context()); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to anonymize user")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	session := sessions.Default(c)
+	session.Clear()
+	if err := session.Save(); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to save session")
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -2,23 +2,51 @@ package gophermart
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/alexedwards/argon2id"
 	"github.com/gin-contrib/logger"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
-	"golang.org/x/sync/errgroup"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+
+	"github.com/kazauwa/gophermart/internal/metrics"
+	"github.com/kazauwa/gophermart/internal/middlewares"
+	"github.com/kazauwa/gophermart/internal/notify"
+	"github.com/kazauwa/gophermart/internal/storage"
+	"github.com/kazauwa/gophermart/internal/tokens"
+	"github.com/kazauwa/gophermart/internal/tracing"
 )
 
+const sessionCookieName = "_gophermart_s"
+
+var ErrShutdownTimeout = errors.New("shutdown deadline exceeded")
+
 type Gophermart struct {
-	cfg    *Config
-	client *http.Client
+	// lastPollerTick holds the unix nano time of the last successful poller
+	// run. It is accessed atomically and kept first for 64-bit alignment.
+	lastPollerTick int64
+
+	cfg              *Config
+	client           *http.Client
+	tokens           *tokens.KeySet
+	notifier         notify.Notifier
+	loginLockout     *lockoutTracker
+	ipLockout        *lockoutTracker
+	twoFactorLockout *lockoutTracker
+	dummyHash        string
+	oidc             *oidcProvider
+	// background tracks work that outlives its request, such as delivering
+	// password reset tokens. Shutdown waits for it.
+	background sync.WaitGroup
 }
 
 func newHTTPClient() *http.Client {
@@ -29,27 +57,82 @@ func newHTTPClient() *http.Client {
 
 	return &http.Client{
 		Timeout:   10 * time.Second,
-		Transport: transport,
+		Transport: tracing.InstrumentTransport(metrics.InstrumentAccrualTransport(transport)),
 	}
 }
 
-func GetGophermartApp(cfg *Config) *Gophermart {
-	return &Gophermart{
-		cfg:    cfg,
-		client: newHTTPClient(),
+// newOIDCHTTPClient returns the client for identity provider calls. It is kept
+// apart from the accrual client so they do not show up in accrual metrics.
+func newOIDCHTTPClient() *http.Client {
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: tracing.InstrumentTransport(http.DefaultTransport.(*http.Transport).Clone()),
+	}
+}
+
+func GetGophermartApp(cfg *Config) (*Gophermart, error) {
+	lockout := cfg.LoginLockout
+	app := &Gophermart{
+		cfg:      cfg,
+		client:   newHTTPClient(),
+		notifier: notify.NewLogNotifier(),
+		loginLockout: newLockoutTracker(
+			lockout.MaxAttemptsPerLogin, lockout.BaseLockout, lockout.MaxLockout,
+		),
+		ipLockout: newLockoutTracker(
+			lockout.MaxAttemptsPerIP, lockout.BaseLockout, lockout.MaxLockout,
+		),
+		twoFactorLockout: newLockoutTracker(
+			cfg.TwoFactor.MaxAttempts, lockout.BaseLockout, lockout.MaxLockout,
+		),
+	}
+
+	dummyHash, err := argon2id.CreateHash("gophermart-dummy-password", cfg.Argon.Params())
+	if err != nil {
+		return nil, err
+	}
+	app.dummyHash = dummyHash
+
+	if cfg.OIDC.Issuer != "" {
+		provider, err := newOIDCProvider(cfg.OIDC, newOIDCHTTPClient())
+		if err != nil {
+			return nil, err
+		}
+		app.oidc = provider
 	}
+
+	if cfg.NotifierFile != "" {
+		app.notifier = notify.NewFileNotifier(cfg.NotifierFile)
+	}
+
+	if len(cfg.JWTKeys) > 0 {
+		keySet, err := tokens.NewKeySet(cfg.JWTKeys, cfg.JWTSigningKeyID, cfg.AccessTokenTTL)
+		if err != nil {
+			return nil, err
+		}
+		app.tokens = keySet
+	}
+	return app, nil
 }
 
-func (g *Gophermart) Serve() {
+func (g *Gophermart) Serve() error {
 	router := gin.New()
-	router.Use(logger.SetLogger())
+	router.ContextWithFallback = true
+	router.Use(otelgin.Middleware(tracing.ServiceName))
+	router.Use(middlewares.RequestID)
+	router.Use(middlewares.AuditRequest)
+	router.Use(metrics.Middleware)
+	router.Use(logger.SetLogger(logger.WithLogger(middlewares.AccessLogger)))
 	router.Use(gin.Recovery())
 	store := cookie.NewStore([]byte(g.cfg.CookieSecret))
-	router.Use(sessions.Sessions("_gophermart_s", store))
-	// TODO: configure via env
-	err := router.SetTrustedProxies(nil)
+	router.Use(sessions.Sessions(sessionCookieName, store))
+	router.Use(middlewares.BearerTokens(g.tokens))
+	// Without trusted proxies gin ignores forwarded headers and uses the
+	// connection address as the client IP.
+	router.RemoteIPHeaders = []string{g.cfg.ClientIPHeader}
+	err := router.SetTrustedProxies(g.cfg.TrustedProxies)
 	if err != nil {
-		log.Fatal().Err(err).Caller().Msg("Cannot start service")
+		return err
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -57,46 +140,132 @@ func (g *Gophermart) Serve() {
 
 	g.CreateRouter(router)
 
+	if err := metrics.RegisterPool(storage.GetDB().Pool); err != nil {
+		log.Err(err).Caller().Msg("cannot register pool metrics")
+	}
+
+	// Plaintext connections are served as HTTP/1.1; HTTP/2 is only negotiated
+	// over TLS.
 	server := &http.Server{
 		Addr:    g.cfg.RunAddr,
 		Handler: router,
 	}
 
+	if g.cfg.TLS.Enabled() {
+		tlsConfig, reloader, err := g.newTLSConfig()
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = tlsConfig
+		go reloader.watch(ctx, g.cfg.TLS.ReloadInterval)
+	}
+
+	servers := []*http.Server{server}
+	serverErrors := make(chan error, 2)
 	go func() {
-		err := server.ListenAndServe()
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
 		if err != nil && err != http.ErrServerClosed {
-			log.Fatal().Err(err).Caller().Msg("Cannot start service")
+			serverErrors <- err
 		}
 	}()
 
+	if g.cfg.MetricsAddr != "" {
+		metricsServer := metrics.NewServer(g.cfg.MetricsAddr)
+		servers = append(servers, metricsServer)
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				serverErrors <- err
+			}
+		}()
+	}
+
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
 
-	errg, errgCtx := errgroup.WithContext(ctx)
+	pollerCtx, stopPoller := context.WithCancel(ctx)
+	workCtx, abortWork := context.WithCancel(context.Background())
+	defer abortWork()
 
-	defer func() {
-		if err := errg.Wait(); err != nil {
-			log.Fatal().Err(err).Caller().Msg("Fatal error")
-		}
+	pollerDone := make(chan error, 1)
+	go func() {
+		pollerDone <- g.ScheduleTasks(pollerCtx, workCtx)
 	}()
 
-	errg.Go(func() error {
-		return g.ScheduleTasks(errgCtx)
-	})
-
+	var runErr error
+	pollerRunning := true
 	select {
-	case <-errgCtx.Done():
-		return
-	case <-signals:
-		log.Info().Msg("Shutting down...")
-		cancel()
-		ctx, cancelTimeout := context.WithTimeout(context.Background(), time.Second*5)
-		defer cancelTimeout()
-
-		err = server.Shutdown(ctx)
-		if err != nil {
-			log.Fatal().Err(err).Caller().Msg("Unable to shutdown gracefully")
+	case runErr = <-pollerDone:
+		pollerRunning = false
+		log.Err(runErr).Caller().Msg("poller stopped")
+	case runErr = <-serverErrors:
+		log.Err(runErr).Caller().Msg("server stopped")
+	case sig := <-signals:
+		log.Info().Str("signal", sig.String()).Msg("Shutting down...")
+	}
+
+	shutdownErr := g.shutdown(servers, stopPoller, abortWork, pollerDone, pollerRunning)
+	if runErr != nil {
+		return runErr
+	}
+	return shutdownErr
+}
+
+// shutdown stops the service in order: the poller is told to stop taking new
+// orders, the servers stop accepting requests and drain the in-flight ones
+// while the poller finishes the order it is working on, and the database pool
+// is closed. Work still running when ShutdownTimeout expires is aborted and
+// ErrShutdownTimeout is returned.
+func (g *Gophermart) shutdown(
+	servers []*http.Server,
+	stopPoller, abortWork context.CancelFunc,
+	pollerDone <-chan error,
+	pollerRunning bool,
+) error {
+	ctx, cancel := context.WithTimeout(context.Background(), g.cfg.ShutdownTimeout)
+	defer cancel()
+
+	stopPoller()
+
+	var shutdownErr error
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Err(err).Caller().Msg("Unable to drain requests before the deadline")
+			shutdownErr = ErrShutdownTimeout
+		}
+	}
+
+	if pollerRunning {
+		select {
+		case err := <-pollerDone:
+			if err != nil && shutdownErr == nil {
+				shutdownErr = err
+			}
+		case <-ctx.Done():
+			log.Warn().Msg("Poller did not finish before the deadline, aborting")
+			abortWork()
+			<-pollerDone
+			shutdownErr = ErrShutdownTimeout
 		}
-		log.Info().Msg("Exiting")
 	}
+
+	backgroundDone := make(chan struct{})
+	go func() {
+		g.background.Wait()
+		close(backgroundDone)
+	}()
+	select {
+	case <-backgroundDone:
+	case <-ctx.Done():
+		log.Warn().Msg("Background work did not finish before the deadline")
+		shutdownErr = ErrShutdownTimeout
+	}
+
+	storage.Close()
+	log.Info().Msg("Exiting")
+	return shutdownErr
 }
@@ -1,11 +1,18 @@
 package gophermart
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/alexedwards/argon2id"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgconn"
@@ -14,41 +21,91 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/shopspring/decimal"
 
+	"github.com/kazauwa/gophermart/internal/metrics"
 	"github.com/kazauwa/gophermart/internal/middlewares"
 	"github.com/kazauwa/gophermart/internal/models"
+	"github.com/kazauwa/gophermart/internal/notify"
 	"github.com/kazauwa/gophermart/internal/utils"
 )
 
+const (
+	maxOrderBatchSize    = 1000
+	passwordResetTimeout = 10 * time.Second
+)
+
+var (
+	errTokensDisabled      = errors.New("token authentication is disabled")
+	errInvalidBatchElement = errors.New("order number must be a string or a number")
+)
+
 func (g *Gophermart) CreateRouter(router *gin.Engine) {
+	router.GET("/healthz", g.liveness)
+	router.GET("/readyz", g.readiness)
+	router.GET(openAPIPath, openAPIHandler(buildOpenAPISpec(apiOperations())))
+
+	g.createAdminRouter(router)
+	g.createPartnerRouter(router)
+
 	userAPI := router.Group("/api/user")
 	authorizationAPI := userAPI.Group("/")
 	authorizationAPI.POST("/register", g.registerUser)
 	authorizationAPI.POST("/login", g.login)
+	authorizationAPI.POST("/login/2fa", g.completeLoginChallenge)
+	authorizationAPI.POST("/token/refresh", g.refreshToken)
+	authorizationAPI.POST("/password/reset", g.requestPasswordReset)
+	authorizationAPI.POST("/password/reset/confirm", g.confirmPasswordReset)
+	authorizationAPI.GET("/oidc/login", g.oidcLogin)
+	authorizationAPI.GET("/oidc/callback", g.oidcCallback)
+
+	userAPI.DELETE("", middlewares.AuthRequired, g.deleteUser)
 
 	authorizedAPI := userAPI.Group("/", middlewares.AuthRequired)
+	authorizedAPI.GET("/export", g.exportUserData)
+	authorizedAPI.POST("/logout", g.logout)
+	authorizedAPI.POST("/password", g.changePassword)
+	authorizedAPI.GET("/sessions", g.listSessions)
+	authorizedAPI.DELETE("/sessions/:id", g.revokeSession)
+	authorizedAPI.POST("/2fa/setup", g.setupTwoFactor)
+	authorizedAPI.POST("/2fa/enable", g.enableTwoFactor)
+	authorizedAPI.POST("/partners/:id/link-token", g.issuePartnerLinkToken)
 	authorizedAPI.POST("/orders", g.uploadOrder)
+	authorizedAPI.POST("/orders/batch", g.uploadOrderBatch)
 	authorizedAPI.GET("/orders", g.listOrders)
+	authorizedAPI.GET("/orders/:number", g.getOrder)
 	authorizedAPI.GET("/balance", g.getBalance)
-	authorizedAPI.POST("/balance/withdraw", g.withdraw)
+	authorizedAPI.POST("/balance/withdraw", middlewares.Idempotent, g.withdraw)
 	authorizedAPI.GET("/balance/withdrawals", g.listWithdrawals)
 }
 
+type credentialsRequest struct {
+	Login       string `json:"login" binding:"required,min=3,max=64"`
+	Password    string `json:"password" binding:"required,min=8"`
+	IssueTokens bool   `json:"issue_tokens"`
+}
+
 func (g *Gophermart) registerUser(c *gin.Context) {
-	var jsonRequest struct {
-		Login    string `json:"login" binding:"required,min=3,max=64"`
-		Password string `json:"password" binding:"required,min=8"`
-	}
+	var jsonRequest credentialsRequest
 
 	if err := c.Bind(&jsonRequest); err != nil {
-		log.Err(err).Caller().Msg("error parsing input")
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	if jsonRequest.IssueTokens && g.tokens == nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errTokensDisabled.Error()})
+		return
+	}
+
+	if models.IsReservedLogin(jsonRequest.Login) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "login is reserved"})
+		return
+	}
+
 	user := models.NewUser()
 	user.Login = jsonRequest.Login
-	if err := user.SetPassword(jsonRequest.Password); err != nil {
-		log.Err(err).Caller().Msg("")
+	if err := user.SetPassword(jsonRequest.Password, g.cfg.Argon.Params()); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
@@ -61,46 +118,79 @@ func (g *Gophermart) registerUser(c *gin.Context) {
 		return
 
 	case err != nil:
-		log.Err(err).Caller().Msg("failed to insert user")
+		log.Ctx(c).Err(err).Caller().Msg("failed to insert user")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
+	recordAudit(c.Request.Context(), models.NewAuditEvent(models.AuditUserRegistered, user.ID, user.ID))
 
-	session := sessions.Default(c)
-	session.Set("user", user.ID)
-	if err := session.Save(); err != nil {
-		log.Err(err).Caller().Msg("failed to save session")
+	if err := g.startSession(c, user); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to save session")
 		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if jsonRequest.IssueTokens {
+		g.respondWithTokens(c, user.ID)
+		return
 	}
 	c.Status(http.StatusOK)
 }
 
 func (g *Gophermart) login(c *gin.Context) {
-	var jsonRequest struct {
-		Login    string `json:"login" binding:"required,min=3,max=64"`
-		Password string `json:"password" binding:"required,min=8"`
-	}
+	var jsonRequest credentialsRequest
 
 	if err := c.Bind(&jsonRequest); err != nil {
-		log.Err(err).Caller().Msg("error parsing input")
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	if jsonRequest.IssueTokens && g.tokens == nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errTokensDisabled.Error()})
+		return
+	}
+
+	clientIP := c.ClientIP()
+	if retryAfter := g.acquireLoginAttempt(jsonRequest.Login, clientIP); retryAfter > 0 {
+		log.Ctx(c).Warn().
+			Str("login", jsonRequest.Login).
+			Str("ip", clientIP).
+			Msg("login attempt during lockout")
+		auditLockedOutLogin(c.Request.Context(), jsonRequest.Login)
+		abortLockedOut(c, retryAfter)
+		return
+	}
+
 	user := models.NewUser()
 	err := user.GetByLogin(c.Request.Context(), jsonRequest.Login)
 
+	var ok bool
 	switch {
 	case errors.Is(err, pgx.ErrNoRows):
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
-		return
+		_, err = argon2id.ComparePasswordAndHash(jsonRequest.Password, g.dummyHash)
+		if err != nil {
+			log.Ctx(c).Err(err).Caller().Msg("failed to check password")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
 
 	case err != nil:
-		log.Err(err).Caller().Msg("failed to fetch user")
+		log.Ctx(c).Err(err).Caller().Msg("failed to fetch user")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 
-	case user == nil:
+	default:
+		ok, err = user.CheckPassword(jsonRequest.Password)
+		if err != nil {
+			log.Ctx(c).Err(err).Caller().Msg("failed to check password")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if !ok {
+		g.recordLoginFailure(c.Request.Context(), user.ID, jsonRequest.Login, clientIP, "invalid credentials")
 		c.AbortWithStatusJSON(
 			http.StatusUnauthorized,
 			gin.H{"error": "invalid credentials"},
@@ -108,66 +198,557 @@ func (g *Gophermart) login(c *gin.Context) {
 		return
 	}
 
-	ok, err := user.CheckPassword(jsonRequest.Password)
+	if user.Blocked {
+		event := models.NewAuditEvent(models.AuditLoginFailed, user.ID, user.ID)
+		event.Details["reason"] = "account is blocked"
+		recordAudit(c.Request.Context(), event)
+		g.releaseLoginAttempt(jsonRequest.Login, clientIP)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "account is blocked"})
+		return
+	}
+
+	g.ipLockout.Release(clientIP)
+	passwordRehash := g.passwordRehash(c.Request.Context(), user, jsonRequest.Password)
+
+	if user.TOTPEnabled {
+		// The password alone is not a successful login: earlier failures for
+		// this login stay counted until the second factor is verified.
+		g.loginLockout.Release(jsonRequest.Login)
+		g.issueLoginChallenge(c, user, jsonRequest.IssueTokens, passwordRehash)
+		return
+	}
+	g.savePasswordRehash(c.Request.Context(), user, passwordRehash)
+	g.completeLogin(c, user, jsonRequest.IssueTokens)
+}
+
+// completeLogin starts a session for a user who passed every required
+// authentication step.
+func (g *Gophermart) completeLogin(c *gin.Context, user *models.User, issueTokens bool) {
+	g.loginLockout.Reset(user.Login)
+	if err := g.startSession(c, user); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to save session")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	recordAudit(c.Request.Context(), models.NewAuditEvent(models.AuditLoginSucceeded, user.ID, user.ID))
+
+	if issueTokens {
+		g.respondWithTokens(c, user.ID)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// acquireLoginAttempt reserves an attempt for both the login and the client
+// IP. It returns the remaining lockout if either of them is locked.
+func (g *Gophermart) acquireLoginAttempt(login, clientIP string) time.Duration {
+	if retryAfter := g.ipLockout.Acquire(clientIP); retryAfter > 0 {
+		return retryAfter
+	}
+
+	if retryAfter := g.loginLockout.Acquire(login); retryAfter > 0 {
+		g.ipLockout.Release(clientIP)
+		return retryAfter
+	}
+	return 0
+}
+
+func abortLockedOut(c *gin.Context, retryAfter time.Duration) {
+	abortTooManyAttempts(c, retryAfter, "too many login attempts")
+}
+
+func abortTooManyAttempts(c *gin.Context, retryAfter time.Duration, message string) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": message})
+}
+
+func (g *Gophermart) releaseLoginAttempt(login, clientIP string) {
+	g.loginLockout.Release(login)
+	g.ipLockout.Release(clientIP)
+}
+
+// auditLoginFailure records a failed login. Known users are identified by
+// their id; the login as typed is only kept when it matches no user.
+func auditLoginFailure(ctx context.Context, userID int, login, reason string) {
+	event := models.NewAuditEvent(models.AuditLoginFailed, 0, userID)
+	if userID == 0 {
+		event.Details["login"] = login
+	}
+	event.Details["reason"] = reason
+	recordAudit(ctx, event)
+}
+
+// auditLockedOutLogin records a login attempt rejected by the lockout before
+// the credentials were checked.
+func auditLockedOutLogin(ctx context.Context, login string) {
+	user := models.NewUser()
+	if err := user.GetByLogin(ctx, login); err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		log.Ctx(ctx).Err(err).Caller().Msg("failed to fetch user")
+	}
+	auditLoginFailure(ctx, user.ID, login, "locked out")
+}
+
+func (g *Gophermart) recordLoginFailure(ctx context.Context, userID int, login, clientIP, reason string) {
+	auditLoginFailure(ctx, userID, login, reason)
+
+	// The attempt was already counted by acquireLoginAttempt.
+	if lockout := g.loginLockout.RetryAfter(login); lockout > 0 {
+		log.Ctx(ctx).Warn().
+			Str("login", login).
+			Str("ip", clientIP).
+			Dur("lockout", lockout).
+			Msg("login locked out after repeated failures")
+	}
+
+	if lockout := g.ipLockout.RetryAfter(clientIP); lockout > 0 {
+		log.Ctx(ctx).Warn().
+			Str("ip", clientIP).
+			Dur("lockout", lockout).
+			Msg("client ip locked out after repeated login failures")
+	}
+}
+
+// passwordRehash returns a hash of the password under the configured Argon2id
+// parameters if the stored one is weaker, or an empty string.
+func (g *Gophermart) passwordRehash(ctx context.Context, user *models.User, password string) string {
+	passwordHash, err := user.RehashPassword(password, g.cfg.Argon.Params())
+	if err != nil {
+		log.Ctx(ctx).Err(err).Caller().Int("user_id", user.ID).Msg("failed to rehash password")
+		return ""
+	}
+	return passwordHash
+}
+
+func (g *Gophermart) savePasswordRehash(ctx context.Context, user *models.User, passwordHash string) {
+	if passwordHash == "" {
+		return
+	}
+
+	user.SetPasswordHash(passwordHash)
+	if err := user.UpdatePassword(ctx); err != nil {
+		log.Ctx(ctx).Err(err).Caller().Int("user_id", user.ID).Msg("failed to save rehashed password")
+	}
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=8"`
+}
+
+func (g *Gophermart) changePassword(c *gin.Context) {
+	ctx := c.Request.Context()
+	userValue, _ := c.Get("user")
+	currentUser, ok := userValue.(*models.User)
+	if !ok {
+		log.Ctx(c).Error().Caller().Msg("malformed user in session")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var jsonRequest changePasswordRequest
+
+	if err := c.Bind(&jsonRequest); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ok, err := currentUser.CheckPassword(jsonRequest.CurrentPassword)
 	if err != nil {
-		log.Err(err).Caller().Msg("failed to check password")
+		log.Ctx(c).Err(err).Caller().Msg("failed to check password")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
 	if !ok {
-		c.AbortWithStatusJSON(
-			http.StatusUnauthorized,
-			gin.H{"error": "invalid credentials"},
-		)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+		return
+	}
+
+	if err := currentUser.SetPassword(jsonRequest.NewPassword, g.cfg.Argon.Params()); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err := currentUser.UpdatePassword(ctx); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to save password")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	recordAudit(ctx, models.NewAuditEvent(models.AuditPasswordChanged, currentUser.ID, currentUser.ID))
+
+	var currentSessionID int
+	if sessionValue, ok := c.Get("session"); ok {
+		if currentSession, ok := sessionValue.(*models.Session); ok {
+			currentSessionID = currentSession.ID
+		}
+	}
+
+	if err := models.RevokeUserSessions(ctx, currentUser.ID, currentSessionID); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to revoke sessions")
+		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
+	event := models.NewAuditEvent(models.AuditSessionRevoked, currentUser.ID, currentUser.ID)
+	event.Details["reason"] = "password changed"
+	event.Details["kept_session_id"] = currentSessionID
+	recordAudit(ctx, event)
+	c.Status(http.StatusOK)
+}
+
+type passwordResetRequest struct {
+	Login string `json:"login" binding:"required,min=3,max=64"`
+}
+
+func (g *Gophermart) requestPasswordReset(c *gin.Context) {
+	var jsonRequest passwordResetRequest
+
+	if err := c.Bind(&jsonRequest); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The token is issued and delivered in the background, so the response
+	// time does not reveal whether the login exists.
+	ctx, cancel := context.WithTimeout(log.Ctx(c).WithContext(context.Background()), passwordResetTimeout)
+	g.background.Add(1)
+	go func() {
+		defer g.background.Done()
+		defer cancel()
+		g.sendPasswordReset(ctx, jsonRequest.Login)
+	}()
+	c.Status(http.StatusAccepted)
+}
+
+func (g *Gophermart) sendPasswordReset(ctx context.Context, login string) {
+	user := models.NewUser()
+	err := user.GetByLogin(ctx, login)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return
+
+	case err != nil:
+		log.Ctx(ctx).Err(err).Caller().Msg("failed to fetch user")
+		return
+	}
+
+	token, err := user.IssuePasswordResetToken(ctx, g.cfg.PasswordResetTTL)
+	if err != nil {
+		log.Ctx(ctx).Err(err).Caller().Msg("failed to issue password reset token")
+		return
+	}
+
+	err = g.notifier.Notify(ctx, &notify.Message{
+		Recipient: user.Login,
+		Subject:   "Password reset",
+		Body:      fmt.Sprintf("Use this token to reset your password: %s", token),
+	})
+	if err != nil {
+		log.Ctx(ctx).Err(err).Caller().Msg("failed to deliver password reset token")
+	}
+}
+
+type passwordResetConfirmRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,min=8"`
+}
+
+func (g *Gophermart) confirmPasswordReset(c *gin.Context) {
+	var jsonRequest passwordResetConfirmRequest
+
+	if err := c.Bind(&jsonRequest); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := models.ResetPassword(
+		c.Request.Context(),
+		jsonRequest.Token,
+		jsonRequest.NewPassword,
+		g.cfg.Argon.Params(),
+	)
+	switch {
+	case errors.Is(err, models.ErrInvalidResetToken):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+
+	case err != nil:
+		log.Ctx(c).Err(err).Caller().Msg("failed to reset password")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func (g *Gophermart) startSession(c *gin.Context, user *models.User) error {
+	userSession := models.NewSession(user.ID, c.Request.UserAgent(), c.ClientIP())
+	if err := userSession.Insert(c.Request.Context(), g.cfg.SessionTTL); err != nil {
+		return err
+	}
+
 	session := sessions.Default(c)
-	session.Set("user", user.ID)
-	if err = session.Save(); err != nil {
-		log.Err(err).Caller().Msg("failed to save session")
+	session.Set(middlewares.SessionTokenKey, userSession.Token())
+	return session.Save()
+}
+
+type logoutRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+func (g *Gophermart) logout(c *gin.Context) {
+	sessionValue, ok := c.Get("session")
+	if !ok {
+		g.logoutBearer(c)
+		return
+	}
+
+	userSession, ok := sessionValue.(*models.Session)
+	if !ok {
+		log.Ctx(c).Error().Caller().Msg("malformed session")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err := userSession.Revoke(c.Request.Context()); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to revoke session")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
+	event := models.NewAuditEvent(models.AuditSessionRevoked, userSession.UserID, userSession.UserID)
+	event.Details["session_id"] = userSession.ID
+	event.Details["reason"] = "logout"
+	recordAudit(c.Request.Context(), event)
+
+	session := sessions.Default(c)
+	session.Clear()
+	if err := session.Save(); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to save session")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
 	c.Status(http.StatusOK)
 }
 
-func (g *Gophermart) uploadOrder(c *gin.Context) {
-	defer c.Request.Body.Close()
-	buf, err := io.ReadAll(c.Request.Body)
+// logoutBearer revokes the refresh token of a bearer-token caller. Access
+// tokens are stateless and stay valid until they expire.
+func (g *Gophermart) logoutBearer(c *gin.Context) {
+	userValue, _ := c.Get("user")
+	currentUser, ok := userValue.(*models.User)
+	if !ok {
+		log.Ctx(c).Error().Caller().Msg("malformed user in session")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var jsonRequest logoutRequest
+
+	if err := c.Bind(&jsonRequest); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	revoked, err := models.RevokeRefreshToken(c.Request.Context(), currentUser.ID, jsonRequest.RefreshToken)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to revoke refresh token")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !revoked {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid refresh token"})
+		return
+	}
+
+	event := models.NewAuditEvent(models.AuditSessionRevoked, currentUser.ID, currentUser.ID)
+	event.Details["reason"] = "logout"
+	event.Details["credential"] = "refresh_token"
+	recordAudit(c.Request.Context(), event)
+	c.Status(http.StatusOK)
+}
+
+func (g *Gophermart) listSessions(c *gin.Context) {
+	userValue, _ := c.Get("user")
+	currentUser, ok := userValue.(*models.User)
+	if !ok {
+		log.Ctx(c).Error().Caller().Msg("malformed user in session")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	userSessions, err := currentUser.GetActiveSessions(c.Request.Context())
 	if err != nil {
-		log.Err(err).Caller().Msg("error parsing input")
+		log.Ctx(c).Err(err).Caller().Msg("cannot fetch user sessions")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var currentSessionID int
+	if sessionValue, ok := c.Get("session"); ok {
+		if currentSession, ok := sessionValue.(*models.Session); ok {
+			currentSessionID = currentSession.ID
+		}
+	}
+
+	for _, userSession := range userSessions {
+		userSession.Current = userSession.ID == currentSessionID
+	}
+	c.JSON(http.StatusOK, userSessions)
+}
+
+func (g *Gophermart) revokeSession(c *gin.Context) {
+	userValue, _ := c.Get("user")
+	currentUser, ok := userValue.(*models.User)
+	if !ok {
+		log.Ctx(c).Error().Caller().Msg("malformed user in session")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	sessionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	orderID, err := strconv.ParseInt(string(buf), 10, 64)
+	revoked, err := models.RevokeSession(c.Request.Context(), currentUser.ID, sessionID)
 	if err != nil {
-		log.Err(err).Caller().Msg("error parsing input")
+		log.Ctx(c).Err(err).Caller().Msg("failed to revoke session")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !revoked {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	event := models.NewAuditEvent(models.AuditSessionRevoked, currentUser.ID, currentUser.ID)
+	event.Details["session_id"] = sessionID
+	recordAudit(c.Request.Context(), event)
+	c.Status(http.StatusNoContent)
+}
+
+func (g *Gophermart) tokenResponse(accessToken, refreshToken string) gin.H {
+	return gin.H{
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(g.tokens.AccessTTL().Seconds()),
+	}
+}
+
+func (g *Gophermart) respondWithTokens(c *gin.Context, userID int) {
+	accessToken, err := g.tokens.IssueAccessToken(userID)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to issue access token")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	refreshToken, err := models.IssueRefreshToken(c.Request.Context(), userID, g.cfg.RefreshTokenTTL)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to issue refresh token")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, g.tokenResponse(accessToken, refreshToken))
+}
+
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+func (g *Gophermart) refreshToken(c *gin.Context) {
+	if g.tokens == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": errTokensDisabled.Error()})
+		return
+	}
+
+	var jsonRequest refreshTokenRequest
+
+	if err := c.Bind(&jsonRequest); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if !utils.IsValidLuhn(orderID) {
-		log.Error().Caller().Int64("order_id", orderID).Msg("luhn validation failed")
-		c.AbortWithStatus(http.StatusUnprocessableEntity)
+	userID, refreshToken, err := models.RotateRefreshToken(
+		c.Request.Context(),
+		jsonRequest.RefreshToken,
+		g.cfg.RefreshTokenTTL,
+	)
+	switch {
+	case errors.Is(err, models.ErrInvalidRefreshToken):
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+		return
+
+	case err != nil:
+		log.Ctx(c).Err(err).Caller().Msg("failed to rotate refresh token")
+		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	order := models.NewOrder()
-	err = order.GetByID(c.Request.Context(), orderID)
-	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
-		log.Err(err).Caller().Msg("error fetching order from db")
+	accessToken, err := g.tokens.IssueAccessToken(userID)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to issue access token")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
+	c.JSON(http.StatusOK, g.tokenResponse(accessToken, refreshToken))
+}
+
+func (g *Gophermart) uploadOrder(c *gin.Context) {
+	defer c.Request.Body.Close()
+	buf, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	orderID, err := utils.ParseOrderNumber(string(buf))
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	userValue, _ := c.Get("user")
 	currentUser, ok := userValue.(*models.User)
 	if !ok {
-		log.Error().Caller().Msg("malformed user in session")
+		log.Ctx(c).Error().Caller().Msg("malformed user in session")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	g.registerOrder(c, currentUser.ID, orderID, models.SourceUser)
+}
+
+func (g *Gophermart) registerOrder(
+	c *gin.Context,
+	userID int,
+	orderID utils.OrderNumber,
+	source models.StatusSource,
+) {
+	if !orderID.IsValidLuhn() {
+		log.Ctx(c).Error().Caller().Str("order_id", orderID.String()).Msg("luhn validation failed")
+		c.AbortWithStatus(http.StatusUnprocessableEntity)
+		return
+	}
+
+	order := models.NewOrder()
+	err := order.GetByID(c.Request.Context(), orderID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		log.Ctx(c).Err(err).Caller().Msg("error fetching order from db")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
@@ -176,17 +757,17 @@ func (g *Gophermart) uploadOrder(c *gin.Context) {
 	case errors.Is(err, pgx.ErrNoRows):
 		order := models.NewOrder()
 		order.ID = orderID
-		order.UserID = currentUser.ID
-		err = order.Insert(c.Request.Context())
+		order.UserID = userID
+		err = order.Insert(c.Request.Context(), source)
 		if err != nil {
-			log.Err(err).Caller().Msg("error inserting order")
+			log.Ctx(c).Err(err).Caller().Msg("error inserting order")
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
 		c.Status(http.StatusAccepted)
 		return
 
-	case order.UserID != currentUser.ID:
+	case order.UserID != userID:
 		c.AbortWithStatus(http.StatusConflict)
 		return
 
@@ -196,19 +777,154 @@ func (g *Gophermart) uploadOrder(c *gin.Context) {
 	}
 }
 
+func parseOrderBatch(contentType string, body []byte) ([]string, error) {
+	if contentType != "application/json" {
+		numbers := make([]string, 0)
+		for _, line := range strings.Split(string(body), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" {
+				numbers = append(numbers, line)
+			}
+		}
+		return numbers, nil
+	}
+
+	var rawNumbers []json.RawMessage
+	if err := json.Unmarshal(body, &rawNumbers); err != nil {
+		return nil, err
+	}
+
+	numbers := make([]string, 0, len(rawNumbers))
+	for i, raw := range rawNumbers {
+		number, err := decodeOrderBatchElement(raw)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %w", i, err)
+		}
+		numbers = append(numbers, number)
+	}
+	return numbers, nil
+}
+
+// decodeOrderBatchElement accepts an order number given either as a JSON
+// string or as a bare JSON number.
+func decodeOrderBatchElement(raw json.RawMessage) (string, error) {
+	if string(raw) == "null" {
+		return "", errInvalidBatchElement
+	}
+
+	var number string
+	if err := json.Unmarshal(raw, &number); err == nil {
+		return number, nil
+	}
+
+	var numeric json.Number
+	if err := json.Unmarshal(raw, &numeric); err != nil {
+		return "", errInvalidBatchElement
+	}
+	return numeric.String(), nil
+}
+
+type batchResult struct {
+	Number string              `json:"number"`
+	Result models.UploadResult `json:"result"`
+}
+
+func (g *Gophermart) uploadOrderBatch(c *gin.Context) {
+	defer c.Request.Body.Close()
+	buf, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	numbers, err := parseOrderBatch(c.ContentType(), buf)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch {
+	case len(numbers) == 0:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "empty batch"})
+		return
+
+	case len(numbers) > maxOrderBatchSize:
+		c.AbortWithStatusJSON(
+			http.StatusRequestEntityTooLarge,
+			gin.H{"error": fmt.Sprintf("batch size exceeds %d orders", maxOrderBatchSize)},
+		)
+		return
+	}
+
+	userValue, _ := c.Get("user")
+	currentUser, ok := userValue.(*models.User)
+	if !ok {
+		log.Ctx(c).Error().Caller().Msg("malformed user in session")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	orderIDs := make([]utils.OrderNumber, 0, len(numbers))
+	parsed := make(map[string]utils.OrderNumber, len(numbers))
+	seen := make(map[utils.OrderNumber]bool, len(numbers))
+	for _, number := range numbers {
+		orderID, err := utils.ParseOrderNumber(number)
+		if err != nil || !orderID.IsValidLuhn() {
+			continue
+		}
+
+		parsed[number] = orderID
+		if !seen[orderID] {
+			seen[orderID] = true
+			orderIDs = append(orderIDs, orderID)
+		}
+	}
+
+	uploaded := make(map[utils.OrderNumber]models.UploadResult)
+	if len(orderIDs) > 0 {
+		uploaded, err = models.InsertOrders(c.Request.Context(), currentUser.ID, orderIDs)
+		if err != nil {
+			log.Ctx(c).Err(err).Caller().Msg("error inserting orders")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	response := make([]batchResult, 0, len(numbers))
+	reported := make(map[utils.OrderNumber]bool, len(orderIDs))
+	for _, number := range numbers {
+		orderID, ok := parsed[number]
+		if !ok {
+			response = append(response, batchResult{Number: number, Result: models.UploadInvalid})
+			continue
+		}
+
+		result := uploaded[orderID]
+		if reported[orderID] && result == models.UploadAccepted {
+			result = models.UploadAlreadyUploaded
+		}
+		reported[orderID] = true
+		response = append(response, batchResult{Number: number, Result: result})
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
 func (g *Gophermart) listOrders(c *gin.Context) {
 	ctx := c.Request.Context()
 	userValue, _ := c.Get("user")
 	currentUser, ok := userValue.(*models.User)
 	if !ok {
-		log.Error().Caller().Msg("malformed user in session")
+		log.Ctx(c).Error().Caller().Msg("malformed user in session")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
 	userOrders, err := currentUser.GetOrders(ctx)
 	if err != nil {
-		log.Err(err).Caller().Msg("cannot fetch user orders")
+		log.Ctx(c).Err(err).Caller().Msg("cannot fetch user orders")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
@@ -220,23 +936,86 @@ func (g *Gophermart) listOrders(c *gin.Context) {
 	c.JSON(http.StatusOK, userOrders)
 }
 
-func (g *Gophermart) getBalance(c *gin.Context) {
+func (g *Gophermart) getOrder(c *gin.Context) {
+	ctx := c.Request.Context()
 	userValue, _ := c.Get("user")
 	currentUser, ok := userValue.(*models.User)
 	if !ok {
-		log.Error().Caller().Msg("malformed user in session")
+		log.Ctx(c).Error().Caller().Msg("malformed user in session")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	orderID, err := utils.ParseOrderNumber(c.Param("number"))
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	order := models.NewOrder()
+	err = order.GetByID(ctx, orderID)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+
+	case err != nil:
+		log.Ctx(c).Err(err).Caller().Msg("error fetching order from db")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+
+	case order.UserID != currentUser.ID:
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	history, err := order.GetStatusHistory(ctx)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("cannot fetch order status history")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	var response struct {
-		Balance   decimal.Decimal `json:"current"`
-		Withdrawn decimal.Decimal `json:"withdrawn"`
+	details := &models.OrderDetails{
+		Order:   order,
+		History: history,
 	}
 
+	withdrawal := models.NewWithdrawal()
+	err = withdrawal.GetByOrderID(ctx, order.ID, currentUser.ID)
+	switch {
+	case err == nil:
+		details.Withdrawal = withdrawal
+
+	case !errors.Is(err, pgx.ErrNoRows):
+		log.Ctx(c).Err(err).Caller().Msg("cannot fetch order withdrawal")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, details)
+}
+
+type balanceResponse struct {
+	Balance   decimal.Decimal `json:"current"`
+	Withdrawn decimal.Decimal `json:"withdrawn"`
+}
+
+func (g *Gophermart) getBalance(c *gin.Context) {
+	userValue, _ := c.Get("user")
+	currentUser, ok := userValue.(*models.User)
+	if !ok {
+		log.Ctx(c).Error().Caller().Msg("malformed user in session")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var response balanceResponse
+
 	totalWithdrawn, err := currentUser.TotalWithdrawn(c.Request.Context())
 	if err != nil {
-		log.Err(err).Caller().Msg("cannot fetch withdrawal sum from db")
+		log.Ctx(c).Err(err).Caller().Msg("cannot fetch withdrawal sum from db")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
@@ -246,45 +1025,52 @@ func (g *Gophermart) getBalance(c *gin.Context) {
 	c.JSON(http.StatusOK, response)
 }
 
+type withdrawRequest struct {
+	OrderID string          `json:"order"`
+	Sum     decimal.Decimal `json:"sum"`
+	OTPCode string          `json:"otp_code"`
+}
+
 func (g *Gophermart) withdraw(c *gin.Context) {
 	userValue, _ := c.Get("user")
 	currentUser, ok := userValue.(*models.User)
 	if !ok {
-		log.Error().Caller().Msg("malformed user in session")
+		log.Ctx(c).Error().Caller().Msg("malformed user in session")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	var jsonRequest struct {
-		OrderID string          `json:"order"`
-		Sum     decimal.Decimal `json:"sum"`
-	}
+	var jsonRequest withdrawRequest
 
 	if err := c.Bind(&jsonRequest); err != nil {
-		log.Err(err).Caller().Msg("error parsing input")
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	orderID, err := strconv.ParseInt(jsonRequest.OrderID, 10, 64)
+	orderID, err := utils.ParseOrderNumber(jsonRequest.OrderID)
 	if err != nil {
-		log.Err(err).Caller().Msg("error parsing input")
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if !utils.IsValidLuhn(orderID) {
-		log.Error().Caller().Int64("order_id", orderID).Msg("luhn validation failed")
+	if !orderID.IsValidLuhn() {
+		log.Ctx(c).Error().Caller().Str("order_id", orderID.String()).Msg("luhn validation failed")
 		c.AbortWithStatus(http.StatusUnprocessableEntity)
 		return
 	}
 
 	ctx := c.Request.Context()
+	if !g.checkWithdrawalCode(c, currentUser, jsonRequest.Sum, jsonRequest.OTPCode) {
+		return
+	}
+
 	order := models.NewOrder()
 	err = order.GetByID(ctx, orderID)
 	switch {
 	case err != nil && !errors.Is(err, pgx.ErrNoRows):
-		log.Err(err).Caller().Msg("error looking up order id")
+		log.Ctx(c).Err(err).Caller().Msg("error looking up order id")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 
@@ -301,16 +1087,18 @@ func (g *Gophermart) withdraw(c *gin.Context) {
 		return
 
 	case errors.As(err, &pgerror) && pgerror.Code == pgerrcode.UniqueViolation:
-		log.Error().Caller().Msg("withdrawal for order already registered")
+		log.Ctx(c).Error().Caller().Msg("withdrawal for order already registered")
 		c.AbortWithStatus(http.StatusConflict)
 		return
 
 	case err != nil:
-		log.Err(err).Caller().Msg("error withdrawing points")
+		log.Ctx(c).Err(err).Caller().Msg("error withdrawing points")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
+	metrics.AddWithdrawal(jsonRequest.Sum)
+
 	c.Status(http.StatusOK)
 }
 
@@ -318,14 +1106,14 @@ func (g *Gophermart) listWithdrawals(c *gin.Context) {
 	userValue, _ := c.Get("user")
 	currentUser, ok := userValue.(*models.User)
 	if !ok {
-		log.Error().Caller().Msg("malformed user in session")
+		log.Ctx(c).Error().Caller().Msg("malformed user in session")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
 	withdrawals, err := currentUser.GetWithdrawalHistory(c.Request.Context())
 	if err != nil {
-		log.Err(err).Caller().Msg("cannot fetch withdrawals from db")
+		log.Ctx(c).Err(err).Caller().Msg("cannot fetch withdrawals from db")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
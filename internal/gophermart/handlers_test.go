@@ -0,0 +1,29 @@
+package gophermart
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRegisterRejectsReservedLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	g := &Gophermart{cfg: NewConfig()}
+	router.POST("/api/user/register", g.registerUser)
+
+	for _, login := range []string{"deleted_1", "Deleted_1"} {
+		body := strings.NewReader(`{"login": "` + login + `", "password": "password"}`)
+		request := httptest.NewRequest(http.MethodPost, "/api/user/register", body)
+		request.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", login, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
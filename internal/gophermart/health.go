@@ -0,0 +1,92 @@
+package gophermart
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/kazauwa/gophermart/internal/storage"
+)
+
+const (
+	healthOK   = "ok"
+	healthFail = "fail"
+
+	readinessTimeout = 2 * time.Second
+)
+
+type healthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+func (g *Gophermart) markPollerTick() {
+	atomic.StoreInt64(&g.lastPollerTick, time.Now().UnixNano())
+}
+
+func (g *Gophermart) liveness(c *gin.Context) {
+	c.JSON(http.StatusOK, healthReport{Status: healthOK})
+}
+
+func (g *Gophermart) readiness(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+	defer cancel()
+
+	report := healthReport{
+		Status: healthOK,
+		Checks: map[string]healthCheck{
+			"database":   checkResult(storage.GetDB().Pool.Ping(ctx)),
+			"migrations": checkResult(checkMigrations(ctx)),
+			"poller":     checkResult(g.checkPoller()),
+		},
+	}
+
+	status := http.StatusOK
+	for _, check := range report.Checks {
+		if check.Status != healthOK {
+			report.Status = healthFail
+			status = http.StatusServiceUnavailable
+		}
+	}
+	c.JSON(status, report)
+}
+
+func checkResult(err error) healthCheck {
+	if err != nil {
+		return healthCheck{Status: healthFail, Error: err.Error()}
+	}
+	return healthCheck{Status: healthOK}
+}
+
+func checkMigrations(ctx context.Context) error {
+	pending, err := storage.GetDB().PendingMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	if pending > 0 {
+		return fmt.Errorf("%d migrations pending", pending)
+	}
+	return nil
+}
+
+func (g *Gophermart) checkPoller() error {
+	lastTick := atomic.LoadInt64(&g.lastPollerTick)
+	if lastTick == 0 {
+		return fmt.Errorf("poller has not started")
+	}
+
+	since := time.Since(time.Unix(0, lastTick))
+	if since > g.cfg.PollInterval*time.Duration(g.cfg.PollerStaleTicks) {
+		return fmt.Errorf("last successful tick %s ago", since.Round(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package gophermart
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+)
+
+const maxLockoutEntries = 10000
+
+type lockoutEntry struct {
+	key         string
+	failures    int
+	lockedUntil time.Time
+	lastFailure time.Time
+}
+
+// lockoutTracker counts failed attempts per key. It keeps at most
+// maxLockoutEntries keys and evicts the least recently used one when full.
+type lockoutTracker struct {
+	lock        sync.Mutex
+	entries     map[string]*list.Element
+	recent      *list.List
+	maxAttempts int
+	baseLockout time.Duration
+	maxLockout  time.Duration
+}
+
+func newLockoutTracker(maxAttempts int, baseLockout, maxLockout time.Duration) *lockoutTracker {
+	return &lockoutTracker{
+		entries:     make(map[string]*list.Element),
+		recent:      list.New(),
+		maxAttempts: maxAttempts,
+		baseLockout: baseLockout,
+		maxLockout:  maxLockout,
+	}
+}
+
+func (t *lockoutTracker) isStale(entry *lockoutEntry, now time.Time) bool {
+	return now.After(entry.lockedUntil) && now.Sub(entry.lastFailure) > t.maxLockout
+}
+
+// entry returns the live entry for key, or nil. Stale entries are dropped.
+func (t *lockoutTracker) entry(key string, now time.Time) *lockoutEntry {
+	element, ok := t.entries[key]
+	if !ok {
+		return nil
+	}
+
+	entry := element.Value.(*lockoutEntry)
+	if t.isStale(entry, now) {
+		t.remove(element)
+		return nil
+	}
+	t.recent.MoveToFront(element)
+	return entry
+}
+
+func (t *lockoutTracker) remove(element *list.Element) {
+	t.recent.Remove(element)
+	delete(t.entries, element.Value.(*lockoutEntry).key)
+}
+
+// RetryAfter returns how long the key stays locked, or zero if it is not.
+func (t *lockoutTracker) RetryAfter(key string) time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	entry := t.entry(key, now)
+	if entry == nil || !now.Before(entry.lockedUntil) {
+		return 0
+	}
+	return entry.lockedUntil.Sub(now)
+}
+
+// Acquire reserves an attempt for key before the credentials are checked, so
+// concurrent attempts cannot all slip past the limit. The attempt counts as a
+// failure unless it is handed back with Release. If the key is locked, nothing
+// is reserved and the remaining lockout is returned.
+// Each attempt past the limit doubles the lockout up to maxLockout.
+func (t *lockoutTracker) Acquire(key string) time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	entry := t.entry(key, now)
+	if entry != nil && now.Before(entry.lockedUntil) {
+		return entry.lockedUntil.Sub(now)
+	}
+
+	if entry == nil {
+		if t.recent.Len() >= maxLockoutEntries {
+			t.remove(t.recent.Back())
+		}
+		entry = &lockoutEntry{key: key}
+		t.entries[key] = t.recent.PushFront(entry)
+	}
+
+	entry.failures++
+	entry.lastFailure = now
+	if entry.failures >= t.maxAttempts {
+		exponent := float64(entry.failures - t.maxAttempts)
+		lockout := time.Duration(float64(t.baseLockout) * math.Pow(2, exponent))
+		if lockout <= 0 || lockout > t.maxLockout {
+			lockout = t.maxLockout
+		}
+		entry.lockedUntil = now.Add(lockout)
+	}
+	return 0
+}
+
+// Release hands back an attempt reserved by Acquire that did not fail.
+func (t *lockoutTracker) Release(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	entry := t.entry(key, time.Now())
+	if entry == nil || entry.failures == 0 {
+		return
+	}
+
+	entry.failures--
+	if entry.failures < t.maxAttempts {
+		entry.lockedUntil = time.Time{}
+	}
+}
+
+func (t *lockoutTracker) Reset(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if element, ok := t.entries[key]; ok {
+		t.remove(element)
+	}
+}
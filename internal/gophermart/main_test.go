@@ -0,0 +1,12 @@
+package gophermart
+
+import (
+	"os"
+	"testing"
+
+	"github.com/kazauwa/gophermart/internal/storage/storagetest"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(storagetest.Run(m))
+}
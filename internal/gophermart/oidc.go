@@ -0,0 +1,293 @@
+package gophermart
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+
+	"github.com/kazauwa/gophermart/internal/middlewares"
+	"github.com/kazauwa/gophermart/internal/models"
+)
+
+const (
+	oidcStateKey    = "oidc_state"
+	oidcNonceKey    = "oidc_nonce"
+	oidcAuthUserKey = "oidc_auth_user"
+	oidcAuthTimeKey = "oidc_auth_time"
+
+	// oidcReauthWindow is how long an identity provider login counts as a
+	// fresh re-authentication for sensitive actions such as account deletion.
+	oidcReauthWindow = 5 * time.Minute
+)
+
+type oidcProvider struct {
+	issuer        string
+	autoProvision bool
+	client        *http.Client
+	verifier      *oidc.IDTokenVerifier
+	oauth2        oauth2.Config
+}
+
+func newOIDCProvider(params *OIDCParams, client *http.Client) (*oidcProvider, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	provider, err := oidc.NewProvider(oidc.ClientContext(ctx, client), params.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &oidcProvider{
+		issuer:        params.Issuer,
+		autoProvision: params.AutoProvision,
+		client:        client,
+		verifier:      provider.Verifier(&oidc.Config{ClientID: params.ClientID}),
+		oauth2: oauth2.Config{
+			ClientID:     params.ClientID,
+			ClientSecret: params.ClientSecret,
+			RedirectURL:  params.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       params.Scopes,
+		},
+	}, nil
+}
+
+func randomState() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func (g *Gophermart) oidcLogin(c *gin.Context) {
+	if g.oidc == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	state, err := randomState()
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to generate oidc state")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	nonce, err := randomState()
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to generate oidc nonce")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	session := sessions.Default(c)
+	session.Set(oidcStateKey, state)
+	session.Set(oidcNonceKey, nonce)
+	if err := session.Save(); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to save session")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Redirect(http.StatusFound, g.oidc.oauth2.AuthCodeURL(state, oidc.Nonce(nonce)))
+}
+
+func (g *Gophermart) oidcCallback(c *gin.Context) {
+	if g.oidc == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	session := sessions.Default(c)
+	state, _ := session.Get(oidcStateKey).(string)
+	nonce, _ := session.Get(oidcNonceKey).(string)
+	session.Delete(oidcStateKey)
+	session.Delete(oidcNonceKey)
+
+	if state == "" || c.Query("state") != state {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid state"})
+		return
+	}
+
+	if errorCode := c.Query("error"); errorCode != "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": errorCode})
+		return
+	}
+
+	ctx := oidc.ClientContext(c.Request.Context(), g.oidc.client)
+	token, err := g.oidc.oauth2.Exchange(ctx, c.Query("code"))
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to exchange oidc code")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid authorization code"})
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing id token"})
+		return
+	}
+
+	idToken, err := g.oidc.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to verify id token")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid id token"})
+		return
+	}
+
+	if idToken.Nonce != nonce {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid nonce"})
+		return
+	}
+
+	var claims struct {
+		PreferredUsername string `json:"preferred_username"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to parse id token claims")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid id token"})
+		return
+	}
+
+	user, ok := g.resolveOIDCUser(c, idToken.Subject, claims.PreferredUsername)
+	if !ok {
+		return
+	}
+
+	if user.Blocked {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "account is blocked"})
+		return
+	}
+
+	session.Set(oidcAuthUserKey, user.ID)
+	session.Set(oidcAuthTimeKey, time.Now().Unix())
+	if err := session.Save(); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to save session")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if user.TOTPEnabled {
+		g.issueLoginChallenge(c, user, false, "")
+		return
+	}
+	g.completeLogin(c, user, false)
+}
+
+// recentOIDCLogin reports whether the user logged in through the identity
+// provider within oidcReauthWindow in this browser session. Users provisioned
+// by the provider have no usable password, so this is how they re-authenticate.
+func recentOIDCLogin(c *gin.Context, user *models.User) bool {
+	session := sessions.Default(c)
+	userID, _ := session.Get(oidcAuthUserKey).(int)
+	authTime, _ := session.Get(oidcAuthTimeKey).(int64)
+	if userID != user.ID || authTime == 0 {
+		return false
+	}
+	return time.Since(time.Unix(authTime, 0)) < oidcReauthWindow
+}
+
+// resolveOIDCUser finds the user linked to the subject. Unknown subjects are
+// linked to the currently logged in user, if any, or provisioned as new users.
+func (g *Gophermart) resolveOIDCUser(c *gin.Context, subject, preferredLogin string) (*models.User, bool) {
+	ctx := c.Request.Context()
+	user := models.NewUser()
+	err := user.GetByIdentity(ctx, g.oidc.issuer, subject)
+	switch {
+	case err == nil:
+		return user, true
+
+	case !errors.Is(err, pgx.ErrNoRows):
+		log.Ctx(c).Err(err).Caller().Msg("failed to fetch user by identity")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if token, ok := sessions.Default(c).Get(middlewares.SessionTokenKey).(string); ok {
+		userSession := &models.Session{}
+		err := userSession.GetActiveByToken(ctx, token)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			log.Ctx(c).Err(err).Caller().Msg("failed to fetch session")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return nil, false
+		}
+
+		if err == nil {
+			if err := user.GetByID(ctx, userSession.UserID); err != nil {
+				log.Ctx(c).Err(err).Caller().Msg("failed to fetch user")
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return nil, false
+			}
+
+			if err := user.LinkIdentity(ctx, g.oidc.issuer, subject); err != nil {
+				log.Ctx(c).Err(err).Caller().Msg("failed to link identity")
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return nil, false
+			}
+
+			event := models.NewAuditEvent(models.AuditIdentityLinked, user.ID, user.ID)
+			event.Details["issuer"] = g.oidc.issuer
+			recordAudit(ctx, event)
+			return user, true
+		}
+	}
+
+	if !g.oidc.autoProvision {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "account is not linked"})
+		return nil, false
+	}
+
+	password, err := randomState()
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to generate password")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if err := user.SetPassword(password, g.cfg.Argon.Params()); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, false
+	}
+
+	subjectHash := sha256.Sum256([]byte(g.oidc.issuer + "|" + subject))
+	fallbackLogin := "oidc_" + hex.EncodeToString(subjectHash[:8])
+	logins := []string{fallbackLogin}
+	if len(preferredLogin) >= 3 && len(preferredLogin) <= 64 && !models.IsReservedLogin(preferredLogin) {
+		logins = []string{preferredLogin, fallbackLogin}
+	}
+
+	for _, login := range logins {
+		user.Login = login
+		err = user.InsertWithIdentity(ctx, g.oidc.issuer, subject)
+		var pgerror *pgconn.PgError
+		if !errors.As(err, &pgerror) || pgerror.Code != pgerrcode.UniqueViolation {
+			break
+		}
+	}
+
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to provision user")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, false
+	}
+
+	event := models.NewAuditEvent(models.AuditUserRegistered, user.ID, user.ID)
+	event.Details["issuer"] = g.oidc.issuer
+	recordAudit(ctx, event)
+	return user, true
+}
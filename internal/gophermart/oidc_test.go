@@ -0,0 +1,296 @@
+package gophermart
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	stubClientID = "gophermart"
+	stubKeyID    = "stub"
+)
+
+// stubIssuer is a minimal OpenID Connect provider serving discovery, JWKS and
+// the token endpoint. Authorization codes are registered by the test together
+// with the claims of the id token they are exchanged for.
+type stubIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	lock     sync.Mutex
+	codes    map[string]jwt.MapClaims
+	lastCode int
+}
+
+func newStubIssuer(t *testing.T) *stubIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := &stubIssuer{key: key, codes: make(map[string]jwt.MapClaims)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("/jwks", issuer.jwks)
+	mux.HandleFunc("/token", issuer.token)
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+func (s *stubIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                s.server.URL,
+		"authorization_endpoint":                s.server.URL + "/authorize",
+		"token_endpoint":                        s.server.URL + "/token",
+		"jwks_uri":                              s.server.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (s *stubIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	encode := func(b []byte) string {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": stubKeyID,
+			"n":   encode(s.key.N.Bytes()),
+			"e":   encode(big.NewInt(int64(s.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (s *stubIssuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	s.lock.Lock()
+	claims, ok := s.codes[r.PostForm.Get("code")]
+	delete(s.codes, r.PostForm.Get("code"))
+	s.lock.Unlock()
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	idToken.Header["kid"] = stubKeyID
+	rawIDToken, err := idToken.SignedString(s.key)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     rawIDToken,
+	})
+}
+
+// issueCode registers an authorization code yielding an id token with the
+// default claims overridden by overrides.
+func (s *stubIssuer) issueCode(nonce string, overrides jwt.MapClaims) string {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":                s.server.URL,
+		"sub":                "subject",
+		"aud":                stubClientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Minute).Unix(),
+		"nonce":              nonce,
+		"preferred_username": "gopher",
+	}
+	for name, value := range overrides {
+		claims[name] = value
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastCode++
+	code := "code-" + strconv.Itoa(s.lastCode)
+	s.codes[code] = claims
+	return code
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func newOIDCTestRouter(t *testing.T, issuer *stubIssuer) *gin.Engine {
+	t.Helper()
+
+	params := &OIDCParams{
+		Issuer:      issuer.server.URL,
+		ClientID:    stubClientID,
+		RedirectURL: "http://gophermart.test/api/user/oidc/callback",
+		Scopes:      []string{"openid"},
+	}
+	provider, err := newOIDCProvider(params, issuer.server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := &Gophermart{cfg: NewConfig(), oidc: provider}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(sessions.Sessions(sessionCookieName, cookie.NewStore([]byte("secret"))))
+	router.GET("/api/user/oidc/login", g.oidcLogin)
+	router.GET("/api/user/oidc/callback", g.oidcCallback)
+	return router
+}
+
+// startOIDCLogin runs the login endpoint and returns the session cookie with
+// the state and nonce it sent to the identity provider.
+func startOIDCLogin(t *testing.T, router *gin.Engine) (*http.Cookie, string, string) {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/user/oidc/login", nil))
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("login: got status %d, want %d", recorder.Code, http.StatusFound)
+	}
+
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("login: got %d cookies, want 1", len(cookies))
+	}
+	return cookies[0], location.Query().Get("state"), location.Query().Get("nonce")
+}
+
+func TestOIDCCallbackRejections(t *testing.T) {
+	issuer := newStubIssuer(t)
+	router := newOIDCTestRouter(t, issuer)
+
+	tests := []struct {
+		name       string
+		callback   func(state, nonce string) url.Values
+		wantStatus int
+		wantError  string
+	}{
+		{
+			name: "foreign state",
+			callback: func(state, nonce string) url.Values {
+				return url.Values{"state": {"forged"}, "code": {issuer.issueCode(nonce, nil)}}
+			},
+			wantStatus: http.StatusBadRequest,
+			wantError:  "invalid state",
+		},
+		{
+			name: "provider error",
+			callback: func(state, nonce string) url.Values {
+				return url.Values{"state": {state}, "error": {"access_denied"}}
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantError:  "access_denied",
+		},
+		{
+			name: "unknown code",
+			callback: func(state, nonce string) url.Values {
+				return url.Values{"state": {state}, "code": {"unknown"}}
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantError:  "invalid authorization code",
+		},
+		{
+			name: "foreign audience",
+			callback: func(state, nonce string) url.Values {
+				code := issuer.issueCode(nonce, jwt.MapClaims{"aud": "someone-else"})
+				return url.Values{"state": {state}, "code": {code}}
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantError:  "invalid id token",
+		},
+		{
+			name: "expired id token",
+			callback: func(state, nonce string) url.Values {
+				code := issuer.issueCode(nonce, jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})
+				return url.Values{"state": {state}, "code": {code}}
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantError:  "invalid id token",
+		},
+		{
+			name: "replayed nonce",
+			callback: func(state, nonce string) url.Values {
+				return url.Values{"state": {state}, "code": {issuer.issueCode("replayed", nil)}}
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantError:  "invalid nonce",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessionCookie, state, nonce := startOIDCLogin(t, router)
+
+			target := "/api/user/oidc/callback?" + tt.callback(state, nonce).Encode()
+			request := httptest.NewRequest(http.MethodGet, target, nil)
+			request.AddCookie(sessionCookie)
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", recorder.Code, tt.wantStatus, recorder.Body)
+			}
+
+			var body struct {
+				Error string `json:"error"`
+			}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error != tt.wantError {
+				t.Errorf("got error %q, want %q", body.Error, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackRejectsStateFromAnotherSession(t *testing.T) {
+	issuer := newStubIssuer(t)
+	router := newOIDCTestRouter(t, issuer)
+	_, state, nonce := startOIDCLogin(t, router)
+	foreignCookie, _, _ := startOIDCLogin(t, router)
+
+	query := url.Values{"state": {state}, "code": {issuer.issueCode(nonce, nil)}}
+	request := httptest.NewRequest(http.MethodGet, "/api/user/oidc/callback?"+query.Encode(), nil)
+	request.AddCookie(foreignCookie)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,717 @@
+package gophermart
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+
+	"github.com/kazauwa/gophermart/internal/middlewares"
+	"github.com/kazauwa/gophermart/internal/models"
+	"github.com/kazauwa/gophermart/internal/utils"
+)
+
+const openAPIPath = "/api/openapi.json"
+
+// schema is a literal JSON schema, used where a handler responds with gin.H
+// rather than a Go type the schema could be derived from.
+type schema = map[string]interface{}
+
+var (
+	userAuth    = []string{"session", "bearer"}
+	adminAuth   = userAuth
+	partnerAuth = []string{"apiKey"}
+
+	errorSchema  = object(schema{"error": schema{"type": "string"}})
+	stringSchema = schema{"type": "string"}
+
+	tokensSchema = object(schema{
+		"access_token":  stringSchema,
+		"refresh_token": stringSchema,
+		"token_type":    stringSchema,
+		"expires_in":    schema{"type": "integer"},
+	})
+)
+
+type apiParam struct {
+	name        string
+	description string
+}
+
+type apiResponse struct {
+	description string
+	// body is either a schema literal or a value whose type describes the
+	// response body.
+	body interface{}
+}
+
+type apiOperation struct {
+	method  string
+	path    string
+	summary string
+	tag     string
+	auth    []string
+	query   []apiParam
+	headers []apiParam
+	// request is either a schema literal or a value whose type describes the
+	// JSON request body.
+	request         interface{}
+	requestOptional bool
+	contentType     string
+	responses       map[int]apiResponse
+}
+
+func object(properties schema) schema {
+	return schema{"type": "object", "properties": properties}
+}
+
+func arrayOf(items interface{}) schema {
+	return schema{"type": "array", "items": items}
+}
+
+func errorResponse(description string) apiResponse {
+	return apiResponse{description: description, body: schema{"$ref": "#/components/schemas/Error"}}
+}
+
+// apiOperations describes every route registered by CreateRouter.
+// TestOpenAPICoversRoutes fails when a route is missing here.
+func apiOperations() []apiOperation {
+	return []apiOperation{
+		{
+			method: http.MethodPost, path: "/api/user/register", tag: "user",
+			summary: "Register a user and start a session",
+			request: credentialsRequest{},
+			responses: map[int]apiResponse{
+				http.StatusOK:         {description: "Registered; tokens are returned when issue_tokens is set", body: tokensSchema},
+				http.StatusBadRequest: errorResponse("Malformed request or reserved login"),
+				http.StatusConflict:   errorResponse("Login is taken"),
+			},
+		},
+		{
+			method: http.MethodPost, path: "/api/user/login", tag: "user",
+			summary: "Log in with login and password",
+			request: credentialsRequest{},
+			responses: map[int]apiResponse{
+				http.StatusOK: {description: "Logged in; tokens are returned when issue_tokens is set", body: tokensSchema},
+				http.StatusAccepted: {description: "Two-factor code required", body: object(schema{
+					"two_factor_required": schema{"type": "boolean"},
+					"challenge":           stringSchema,
+				})},
+				http.StatusBadRequest:      errorResponse("Malformed request"),
+				http.StatusUnauthorized:    errorResponse("Invalid credentials"),
+				http.StatusForbidden:       errorResponse("Account is blocked"),
+				http.StatusTooManyRequests: errorResponse("Too many failed attempts"),
+			},
+		},
+		{
+			method: http.MethodPost, path: "/api/user/login/2fa", tag: "user",
+			summary: "Complete a login with a two-factor code",
+			request: loginChallengeRequest{},
+			responses: map[int]apiResponse{
+				http.StatusOK:              {description: "Logged in", body: tokensSchema},
+				http.StatusUnauthorized:    errorResponse("Invalid challenge or code"),
+				http.StatusTooManyRequests: errorResponse("Too many failed attempts"),
+			},
+		},
+		{
+			method: http.MethodPost, path: "/api/user/token/refresh", tag: "user",
+			summary: "Exchange a refresh token for a new token pair",
+			request: refreshTokenRequest{},
+			responses: map[int]apiResponse{
+				http.StatusOK:           {description: "New token pair", body: tokensSchema},
+				http.StatusUnauthorized: errorResponse("Invalid refresh token"),
+				http.StatusNotFound:     errorResponse("Tokens are disabled"),
+			},
+		},
+		{
+			method: http.MethodPost, path: "/api/user/password/reset", tag: "user",
+			summary: "Request a password reset",
+			request: passwordResetRequest{},
+			responses: map[int]apiResponse{
+				http.StatusAccepted: {description: "Reset instructions sent if the login exists"},
+			},
+		},
+		{
+			method: http.MethodPost, path: "/api/user/password/reset/confirm", tag: "user",
+			summary: "Set a new password with a reset token",
+			request: passwordResetConfirmRequest{},
+			responses: map[int]apiResponse{
+				http.StatusOK:         {description: "Password changed"},
+				http.StatusBadRequest: errorResponse("Invalid or expired token"),
+			},
+		},
+		{
+			method: http.MethodGet, path: "/api/user/oidc/login", tag: "user",
+			summary: "Start an OpenID Connect login",
+			responses: map[int]apiResponse{
+				http.StatusFound:    {description: "Redirect to the identity provider"},
+				http.StatusNotFound: {description: "OpenID Connect is not configured"},
+			},
+		},
+		{
+			method: http.MethodGet, path: "/api/user/oidc/callback", tag: "user",
+			summary: "Finish an OpenID Connect login",
+			query: []apiParam{
+				{name: "state", description: "State issued by the login endpoint"},
+				{name: "code", description: "Authorization code"},
+				{name: "error", description: "Error reported by the identity provider"},
+			},
+			responses: map[int]apiResponse{
+				http.StatusOK: {description: "Logged in"},
+				http.StatusAccepted: {description: "Two-factor code required", body: object(schema{
+					"two_factor_required": schema{"type": "boolean"},
+					"challenge":           stringSchema,
+				})},
+				http.StatusBadRequest:   errorResponse("State does not match the login request"),
+				http.StatusUnauthorized: errorResponse("Login was rejected"),
+				http.StatusForbidden:    errorResponse("Account is blocked or not linked"),
+			},
+		},
+		{
+			method: http.MethodDelete, path: "/api/user", tag: "user", auth: userAuth,
+			summary: "Delete the account",
+			request: deleteUserRequest{},
+			responses: map[int]apiResponse{
+				http.StatusNoContent:    {description: "Account deleted"},
+				http.StatusUnauthorized: errorResponse("Invalid password, or no password and no recent identity provider login"),
+			},
+		},
+		{
+			method: http.MethodGet, path: "/api/user/export", tag: "user", auth: userAuth,
+			summary: "Export all account data",
+			responses: map[int]apiResponse{
+				http.StatusOK: {description: "Account data", body: object(schema{
+					"exported_at": schema{"type": "string", "format": "date-time"},
+					"profile": object(schema{
+						"login":        stringSchema,
+						"role":         stringSchema,
+						"totp_enabled": schema{"type": "boolean"},
+						"balance":      schema{"type": "number"},
+					}),
+					"orders":          arrayOf(models.OrderDetails{}),
+					"withdrawals":     arrayOf(models.Withdrawal{}),
+					"balance_history": arrayOf(models.BalanceEntry{}),
+					"sessions":        arrayOf(models.Session{}),
+				})},
+			},
+		},
+		{
+			method: http.MethodPost, path: "/api/user/logout", tag: "user", auth: userAuth,
+			summary:         "Revoke the current session, or the refresh token of a bearer-token caller",
+			request:         logoutRequest{},
+			requestOptional: true,
+			responses: map[int]apiResponse{
+				http.StatusOK:         {description: "Logged out"},
+				http.StatusBadRequest: errorResponse("Missing or invalid refresh token"),
+			},
+		},
+		{
+			method: http.MethodPost, path: "/api/user/password", tag: "user", auth: userAuth,
+			summary: "Change the password and revoke other sessions",
+			request: changePasswordRequest{},
+			responses: map[int]apiResponse{
+				http.StatusOK:           {description: "Password changed"},
+				http.StatusUnauthorized: errorResponse("Invalid current password"),
+			},
+		},
+		{
+			method: http.MethodGet, path: "/api/user/sessions", tag: "user", auth: userAuth,
+			summary: "List active sessions",
+			responses: map[int]apiResponse{
+				http.StatusOK: {description: "Active sessions", body: []*models.Session{}},
+			},
+		},
+		{
+			method: http.MethodDelete, path: "/api/user/sessions/:id", tag: "user", auth: userAuth,
+			summary: "Revoke a session",
+			responses: map[int]apiResponse{
+				http.StatusNoContent: {description: "Session revoked"},
+				http.StatusNotFound:  {description: "No such session"},
+			},
+		},
+		{
+			method: http.MethodPost, path: "/api/user/2fa/setup", tag: "user", auth: userAuth,
+			summary: "Generate a TOTP secret and recovery codes",
+			responses: map[int]apiResponse{
+				http.StatusOK: {description: "Provisioning data", body: object(schema{
+					"otpauth_uri":    stringSchema,
+					"recovery_codes": arrayOf(stringSchema),
+				})},
+				http.StatusConflict: errorResponse("Two-factor authentication is already enabled"),
+			},
+		},
+		{
+			method: http.MethodPost, path: "/api/user/2fa/enable", tag: "user", auth: userAuth,
+			summary: "Enable two-factor authentication",
+			request: twoFactorCodeRequest{},
+			responses: map[int]apiResponse{
+				http.StatusOK:                  {description: "Enabled"},
+				http.StatusConflict:            errorResponse("Already enabled"),
+				http.StatusUnprocessableEntity: errorResponse("Invalid code"),
+			},
+		},
+		{
+			method: http.MethodPost, path: "/api/user/partners/:id/link-token", tag: "user", auth: userAuth,
+			summary: "Consent to being linked to a partner customer",
+			responses: map[int]apiResponse{
+				http.StatusCreated: {description: "A one-time token to hand over to the partner", body: object(schema{
+					"link_token": stringSchema,
+					"expires_in": schema{"type": "integer"},
+				})},
+				http.StatusNotFound: {description: "No such partner"},
+			},
+		},
+		{
+			method: http.MethodPost, path: "/api/user/orders", tag: "orders", auth: userAuth,
+			summary:     "Upload an order number",
+			request:     stringSchema,
+			contentType: "text/plain",
+			responses: map[int]apiResponse{
+				http.StatusOK:                  {description: "Already uploaded by this user"},
+				http.StatusAccepted:            {description: "Accepted for processing"},
+				http.StatusConflict:            {description: "Uploaded by another user"},
+				http.StatusUnprocessableEntity: {description: "Invalid order number"},
+			},
+		},
+		{
+			method: http.MethodPost, path: "/api/user/orders/batch", tag: "orders", auth: userAuth,
+			summary: "Upload many order numbers at once",
+			request: []string{},
+			responses: map[int]apiResponse{
+				http.StatusOK:         {description: "Result per submitted number", body: []batchResult{}},
+				http.StatusBadRequest: errorResponse("Malformed or oversized batch"),
+			},
+		},
+		{
+			method: http.MethodGet, path: "/api/user/orders", tag: "orders", auth: userAuth,
+			summary: "List uploaded orders",
+			responses: map[int]apiResponse{
+				http.StatusOK:        {description: "Orders, newest first", body: []*models.Order{}},
+				http.StatusNoContent: {description: "No orders"},
+			},
+		},
+		{
+			method: http.MethodGet, path: "/api/user/orders/:number", tag: "orders", auth: userAuth,
+			summary: "Get an order with its status history",
+			responses: map[int]apiResponse{
+				http.StatusOK:       {description: "Order details", body: models.OrderDetails{}},
+				http.StatusNotFound: {description: "No such order"},
+			},
+		},
+		{
+			method: http.MethodGet, path: "/api/user/balance", tag: "balance", auth: userAuth,
+			summary: "Get the current balance",
+			responses: map[int]apiResponse{
+				http.StatusOK: {description: "Balance", body: balanceResponse{}},
+			},
+		},
+		{
+			method: http.MethodPost, path: "/api/user/balance/withdraw", tag: "balance", auth: userAuth,
+			summary: "Withdraw points towards an order",
+			headers: []apiParam{
+				{name: middlewares.IdempotencyKeyHeader, description: "Replays the stored response for a repeated key"},
+			},
+			request: withdrawRequest{},
+			responses: map[int]apiResponse{
+				http.StatusOK:                  {description: "Withdrawn"},
+				http.StatusPaymentRequired:     {description: "Insufficient balance"},
+				http.StatusForbidden:           errorResponse("Two-factor code required or invalid"),
+				http.StatusConflict:            {description: "Order already used or request in progress"},
+				http.StatusUnprocessableEntity: {description: "Invalid order number"},
+				http.StatusTooManyRequests:     errorResponse("Too many failed two-factor attempts"),
+			},
+		},
+		{
+			method: http.MethodGet, path: "/api/user/balance/withdrawals", tag: "balance", auth: userAuth,
+			summary: "List withdrawals",
+			responses: map[int]apiResponse{
+				http.StatusOK:        {description: "Withdrawals", body: []*models.Withdrawal{}},
+				http.StatusNoContent: {description: "No withdrawals"},
+			},
+		},
+		{
+			method: http.MethodGet, path: "/api/admin/users", tag: "admin", auth: adminAuth,
+			summary: "Search users by login",
+			query: []apiParam{
+				{name: "login", description: "Substring of the login"},
+				{name: "limit", description: "Maximum number of users"},
+			},
+			responses: map[int]apiResponse{
+				http.StatusOK: {description: "Matching users", body: []*adminUserView{}},
+			},
+		},
+		{
+			method: http.MethodGet, path: "/api/admin/users/:id", tag: "admin", auth: adminAuth,
+			summary: "Get a user with orders and withdrawals",
+			responses: map[int]apiResponse{
+				http.StatusOK: {description: "User", body: object(schema{
+					"user":        adminUserView{},
+					"withdrawn":   schema{"type": "number"},
+					"orders":      arrayOf(models.Order{}),
+					"withdrawals": arrayOf(models.Withdrawal{}),
+				})},
+				http.StatusNotFound: {description: "No such user"},
+			},
+		},
+		{
+			method: http.MethodPost, path: "/api/admin/users/:id/block", tag: "admin", auth: adminAuth,
+			summary: "Block a user and revoke their sessions",
+			responses: map[int]apiResponse{
+				http.StatusOK:        {description: "Blocked", body: adminUserView{}},
+				http.StatusForbidden: errorResponse("Target role is equal to or above the caller's"),
+			},
+		},
+		{
+			method: http.MethodPost, path: "/api/admin/users/:id/unblock", tag: "admin", auth: adminAuth,
+			summary: "Unblock a user",
+			responses: map[int]apiResponse{
+				http.StatusOK:        {description: "Unblocked", body: adminUserView{}},
+				http.StatusForbidden: errorResponse("Target role is equal to or above the caller's"),
+			},
+		},
+		{
+			method: http.MethodPost, path: "/api/admin/users/:id/adjustments", tag: "admin", auth: adminAuth,
+			summary: "Credit or debit a user's balance",
+			request: adjustBalanceRequest{},
+			responses: map[int]apiResponse{
+				http.StatusOK:       {description: "Adjustment", body: models.BalanceAdjustment{}},
+				http.StatusConflict: errorResponse("Balance would become negative"),
+			},
+		},
+		{
+			method: http.MethodPost, path: "/api/admin/partners", tag: "admin", auth: adminAuth,
+			summary: "Create a partner",
+			request: createPartnerRequest{},
+			responses: map[int]apiResponse{
+				http.StatusCreated:  {description: "Partner", body: models.Partner{}},
+				http.StatusConflict: errorResponse("Partner already exists"),
+			},
+		},
+		{
+			method: http.MethodGet, path: "/api/admin/partners/:id/keys", tag: "admin", auth: adminAuth,
+			summary: "List a partner's API keys",
+			responses: map[int]apiResponse{
+				http.StatusOK: {description: "API keys", body: []*models.APIKey{}},
+			},
+		},
+		{
+			method: http.MethodPost, path: "/api/admin/partners/:id/keys", tag: "admin", auth: adminAuth,
+			summary: "Issue an API key",
+			request: issueAPIKeyRequest{},
+			responses: map[int]apiResponse{
+				http.StatusCreated: {description: "The key, shown only once", body: object(schema{
+					"key":     stringSchema,
+					"api_key": models.APIKey{},
+				})},
+			},
+		},
+		{
+			method: http.MethodDelete, path: "/api/admin/partners/:id/keys/:key_id", tag: "admin", auth: adminAuth,
+			summary: "Revoke an API key",
+			responses: map[int]apiResponse{
+				http.StatusNoContent: {description: "Revoked"},
+				http.StatusNotFound:  {description: "No such key"},
+			},
+		},
+		{
+			method: http.MethodGet, path: "/api/admin/audit", tag: "admin", auth: adminAuth,
+			summary: "Query the audit log",
+			query: []apiParam{
+				{name: "user_id", description: "Events where the user is the subject or the actor"},
+				{name: "from", description: "Inclusive lower bound, RFC 3339"},
+				{name: "to", description: "Exclusive upper bound, RFC 3339"},
+				{name: "limit", description: "Maximum number of events"},
+			},
+			responses: map[int]apiResponse{
+				http.StatusOK: {description: "Events, newest first", body: []*models.AuditEvent{}},
+			},
+		},
+		{
+			method: http.MethodPost, path: "/api/partner/orders", tag: "partner", auth: partnerAuth,
+			summary: "Upload an order on behalf of a customer",
+			request: partnerOrderRequest{},
+			responses: map[int]apiResponse{
+				http.StatusOK:        {description: "Already uploaded for this customer"},
+				http.StatusAccepted:  {description: "Accepted for processing"},
+				http.StatusConflict:  {description: "Uploaded by another user"},
+				http.StatusForbidden: errorResponse("Client certificate required"),
+				http.StatusNotFound:  errorResponse("Customer not found"),
+			},
+		},
+		{
+			method: http.MethodPost, path: "/api/partner/customers", tag: "partner", auth: partnerAuth,
+			summary: "Link a partner customer id to a user",
+			request: linkCustomerRequest{},
+			responses: map[int]apiResponse{
+				http.StatusOK:                  {description: "Linked"},
+				http.StatusForbidden:           errorResponse("Client certificate required"),
+				http.StatusConflict:            errorResponse("Customer is linked to another user"),
+				http.StatusUnprocessableEntity: errorResponse("Invalid, expired or used link token"),
+			},
+		},
+		{
+			method: http.MethodGet, path: "/healthz", tag: "operations",
+			summary: "Liveness probe",
+			responses: map[int]apiResponse{
+				http.StatusOK: {description: "Process is alive", body: healthReport{}},
+			},
+		},
+		{
+			method: http.MethodGet, path: "/readyz", tag: "operations",
+			summary: "Readiness probe",
+			responses: map[int]apiResponse{
+				http.StatusOK:                 {description: "Ready", body: healthReport{}},
+				http.StatusServiceUnavailable: {description: "A check failed", body: healthReport{}},
+			},
+		},
+		{
+			method: http.MethodGet, path: openAPIPath, tag: "operations",
+			summary: "This document",
+			responses: map[int]apiResponse{
+				http.StatusOK: {description: "OpenAPI 3 document"},
+			},
+		},
+	}
+}
+
+var (
+	timeType         = reflect.TypeOf(time.Time{})
+	decimalType      = reflect.TypeOf(decimal.Decimal{})
+	orderNumberType  = reflect.TypeOf(utils.OrderNumber(""))
+	orderDetailsType = reflect.TypeOf(models.OrderDetails{})
+)
+
+// orderDetailsDoc mirrors the JSON written by models.OrderDetails, whose Go
+// fields do not match its output.
+type orderDetailsDoc struct {
+	Number     string                      `json:"number"`
+	Status     models.OrderStatus          `json:"status"`
+	Accrual    *decimal.Decimal            `json:"accrual,omitempty"`
+	UploadedAt time.Time                   `json:"uploaded_at"`
+	History    []*models.OrderStatusChange `json:"history"`
+	Withdrawal *models.Withdrawal          `json:"withdrawal,omitempty"`
+}
+
+type schemaBuilder struct {
+	components schema
+}
+
+// resolve returns the schema of a Go value. Literal schemas are walked and Go
+// values nested in them are replaced with their derived schemas.
+func (b *schemaBuilder) resolve(value interface{}) interface{} {
+	switch v := value.(type) {
+	case schema:
+		for key, property := range v {
+			v[key] = b.resolve(property)
+		}
+		return v
+	case string, bool, int:
+		return v
+	default:
+		return b.typeSchema(reflect.TypeOf(value))
+	}
+}
+
+func (b *schemaBuilder) typeSchema(t reflect.Type) schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t {
+	case timeType:
+		return schema{"type": "string", "format": "date-time"}
+	case decimalType:
+		return schema{"type": "number"}
+	case orderNumberType:
+		return schema{"type": "string", "pattern": "^[0-9]+$"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return schema{"type": "string"}
+	case reflect.Bool:
+		return schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return schema{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return arrayOf(b.typeSchema(t.Elem()))
+	case reflect.Map:
+		return schema{"type": "object", "additionalProperties": b.typeSchema(t.Elem())}
+	case reflect.Struct:
+		return b.structRef(t)
+	default:
+		return schema{}
+	}
+}
+
+func (b *schemaBuilder) structRef(t reflect.Type) schema {
+	name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+	if _, ok := b.components[name]; !ok {
+		b.components[name] = schema{}
+		doc := t
+		if t == orderDetailsType {
+			doc = reflect.TypeOf(orderDetailsDoc{})
+		}
+		b.components[name] = b.structSchema(doc)
+	}
+	return schema{"$ref": "#/components/schemas/" + name}
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type) schema {
+	properties := schema{}
+	required := make([]string, 0)
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := field.Name
+		if tag := field.Tag.Get("json"); tag != "" {
+			name = strings.Split(tag, ",")[0]
+		}
+		if name == "-" {
+			continue
+		}
+
+		property := b.typeSchema(field.Type)
+		for _, rule := range strings.Split(field.Tag.Get("binding"), ",") {
+			key, value, _ := strings.Cut(rule, "=")
+			switch key {
+			case "required":
+				required = append(required, name)
+			case "min", "max":
+				limit, err := strconv.Atoi(value)
+				if err != nil {
+					continue
+				}
+				property[bindingLimit(field.Type, key)] = limit
+			}
+		}
+		properties[name] = property
+	}
+
+	result := object(properties)
+	if len(required) > 0 {
+		result["required"] = required
+	}
+	return result
+}
+
+func bindingLimit(t reflect.Type, rule string) string {
+	suffix := "Length"
+	if t.Kind() == reflect.Slice {
+		suffix = "Items"
+	}
+	return rule + suffix
+}
+
+func openAPIPathOf(ginPath string) (string, []string) {
+	segments := strings.Split(ginPath, "/")
+	params := make([]string, 0)
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			params = append(params, segment[1:])
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+func buildOpenAPISpec(operations []apiOperation) schema {
+	builder := &schemaBuilder{components: schema{"Error": errorSchema}}
+	paths := schema{}
+
+	for _, operation := range operations {
+		path, pathParams := openAPIPathOf(operation.path)
+		parameters := make([]schema, 0)
+		for _, name := range pathParams {
+			parameters = append(parameters, schema{
+				"name": name, "in": "path", "required": true, "schema": stringSchema,
+			})
+		}
+		for _, param := range operation.query {
+			parameters = append(parameters, schema{
+				"name": param.name, "in": "query", "description": param.description, "schema": stringSchema,
+			})
+		}
+
+		for _, param := range operation.headers {
+			parameters = append(parameters, schema{
+				"name": param.name, "in": "header", "description": param.description, "schema": stringSchema,
+			})
+		}
+
+		responses := schema{}
+		for code, response := range operation.responses {
+			entry := schema{"description": response.description}
+			if response.body != nil {
+				entry["content"] = schema{"application/json": schema{"schema": builder.resolve(response.body)}}
+			}
+			responses[strconv.Itoa(code)] = entry
+		}
+
+		spec := schema{
+			"summary":     operation.summary,
+			"operationId": strings.ToLower(operation.method) + strings.NewReplacer("/", "_", ":", "", ".", "_").Replace(operation.path),
+			"tags":        []string{operation.tag},
+			"responses":   responses,
+		}
+		if len(parameters) > 0 {
+			spec["parameters"] = parameters
+		}
+		if operation.request != nil {
+			contentType := operation.contentType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			spec["requestBody"] = schema{
+				"required": !operation.requestOptional,
+				"content":  schema{contentType: schema{"schema": builder.resolve(operation.request)}},
+			}
+		}
+		if len(operation.auth) > 0 {
+			security := make([]schema, 0, len(operation.auth))
+			for _, scheme := range operation.auth {
+				security = append(security, schema{scheme: []string{}})
+			}
+			spec["security"] = security
+		}
+
+		if _, ok := paths[path]; !ok {
+			paths[path] = schema{}
+		}
+		paths[path].(schema)[strings.ToLower(operation.method)] = spec
+	}
+
+	return schema{
+		"openapi": "3.0.3",
+		"info": schema{
+			"title":   "Gophermart",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": schema{
+			"schemas": builder.components,
+			"securitySchemes": schema{
+				"session": schema{"type": "apiKey", "in": "cookie", "name": sessionCookieName},
+				"bearer":  schema{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKey":  schema{"type": "apiKey", "in": "header", "name": middlewares.APIKeyHeader},
+			},
+		},
+	}
+}
+
+func openAPIHandler(spec schema) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, spec)
+	}
+}
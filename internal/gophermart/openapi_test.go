@@ -0,0 +1,34 @@
+package gophermart
+
+import (
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestOpenAPICoversRoutes keeps the document from drifting from the router:
+// every registered route must be documented and every documented route
+// registered.
+func TestOpenAPICoversRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	g := &Gophermart{cfg: NewConfig()}
+	g.CreateRouter(router)
+
+	documented := make(map[string]bool)
+	for _, operation := range apiOperations() {
+		documented[operation.method+" "+operation.path] = true
+	}
+
+	for _, route := range router.Routes() {
+		key := route.Method + " " + route.Path
+		if !documented[key] {
+			t.Errorf("undocumented route %s", key)
+		}
+		delete(documented, key)
+	}
+
+	for key := range documented {
+		t.Errorf("documented route %s is not registered", key)
+	}
+}
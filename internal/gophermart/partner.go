@@ -0,0 +1,322 @@
+package gophermart
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog/log"
+
+	"github.com/kazauwa/gophermart/internal/middlewares"
+	"github.com/kazauwa/gophermart/internal/models"
+	"github.com/kazauwa/gophermart/internal/utils"
+)
+
+// partnerLinkTokenTTL bounds how long a user's consent to be linked to a
+// partner customer can be redeemed.
+const partnerLinkTokenTTL = 15 * time.Minute
+
+func (g *Gophermart) createPartnerRouter(router *gin.Engine) {
+	partnerAPI := router.Group("/api/partner")
+	if g.cfg.TLS.ClientCAFile != "" {
+		// Partners are other services: with a client CA configured they must
+		// present a certificate it issued on top of their API key.
+		partnerAPI.Use(middlewares.ClientCertRequired)
+	}
+	partnerAPI.POST(
+		"/orders",
+		middlewares.APIKeyRequired(models.ScopeOrdersWrite),
+		g.partnerUploadOrder,
+	)
+	partnerAPI.POST(
+		"/customers",
+		middlewares.APIKeyRequired(models.ScopeCustomersWrite),
+		g.partnerLinkCustomer,
+	)
+}
+
+func partnerFromContext(c *gin.Context) (*models.Partner, bool) {
+	partnerValue, _ := c.Get("partner")
+	partner, ok := partnerValue.(*models.Partner)
+	if !ok {
+		log.Ctx(c).Error().Caller().Msg("malformed partner in context")
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}
+	return partner, ok
+}
+
+type partnerOrderRequest struct {
+	Number     string `json:"number" binding:"required"`
+	Login      string `json:"login"`
+	CustomerID string `json:"customer_id"`
+}
+
+func (g *Gophermart) partnerUploadOrder(c *gin.Context) {
+	ctx := c.Request.Context()
+	partner, ok := partnerFromContext(c)
+	if !ok {
+		return
+	}
+
+	var jsonRequest partnerOrderRequest
+
+	if err := c.Bind(&jsonRequest); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if (jsonRequest.Login == "") == (jsonRequest.CustomerID == "") {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{"error": "exactly one of login or customer_id is required"},
+		)
+		return
+	}
+
+	orderID, err := utils.ParseOrderNumber(jsonRequest.Number)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user := models.NewUser()
+	if jsonRequest.Login != "" {
+		err = user.GetByLogin(ctx, jsonRequest.Login)
+	} else {
+		err = user.GetByPartnerCustomer(ctx, partner.ID, jsonRequest.CustomerID)
+	}
+
+	switch {
+	case errors.Is(err, pgx.ErrNoRows) || err == nil && user.Blocked:
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "customer not found"})
+		return
+
+	case err != nil:
+		log.Ctx(c).Err(err).Caller().Msg("failed to fetch user")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	g.registerOrder(c, user.ID, orderID, models.SourcePartner)
+}
+
+type linkCustomerRequest struct {
+	CustomerID string `json:"customer_id" binding:"required,max=255"`
+	LinkToken  string `json:"link_token" binding:"required"`
+}
+
+// partnerLinkCustomer binds a partner customer id to the user who issued the
+// link token, so the partner can only link customers who consented to it.
+func (g *Gophermart) partnerLinkCustomer(c *gin.Context) {
+	partner, ok := partnerFromContext(c)
+	if !ok {
+		return
+	}
+
+	var jsonRequest linkCustomerRequest
+
+	if err := c.Bind(&jsonRequest); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err := partner.LinkCustomer(c.Request.Context(), jsonRequest.CustomerID, jsonRequest.LinkToken)
+	switch {
+	case errors.Is(err, models.ErrInvalidLinkToken):
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+
+	case errors.Is(err, models.ErrCustomerLinked):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+
+	case err != nil:
+		log.Ctx(c).Err(err).Caller().Msg("failed to link customer")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// issuePartnerLinkToken lets the current user consent to being linked to a
+// customer of the partner. The user hands the token over to the partner.
+func (g *Gophermart) issuePartnerLinkToken(c *gin.Context) {
+	user, ok := currentUserFromContext(c)
+	if !ok {
+		return
+	}
+
+	partner, ok := partnerFromParam(c)
+	if !ok {
+		return
+	}
+
+	token, err := user.IssuePartnerLinkToken(c.Request.Context(), partner.ID, partnerLinkTokenTTL)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to issue partner link token")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"link_token": token,
+		"expires_in": int(partnerLinkTokenTTL.Seconds()),
+	})
+}
+
+func partnerFromParam(c *gin.Context) (*models.Partner, bool) {
+	partnerID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	partner := &models.Partner{}
+	err = partner.GetByID(c.Request.Context(), partnerID)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, false
+
+	case err != nil:
+		log.Ctx(c).Err(err).Caller().Msg("failed to fetch partner")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, false
+	}
+	return partner, true
+}
+
+type createPartnerRequest struct {
+	Name string `json:"name" binding:"required,min=1,max=128"`
+}
+
+func (g *Gophermart) adminCreatePartner(c *gin.Context) {
+	var jsonRequest createPartnerRequest
+
+	if err := c.Bind(&jsonRequest); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	partner := models.NewPartner(jsonRequest.Name)
+	err := partner.Insert(c.Request.Context())
+	var pgerror *pgconn.PgError
+	switch {
+	case errors.As(err, &pgerror) && pgerror.Code == pgerrcode.UniqueViolation:
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "partner already exists"})
+		return
+
+	case err != nil:
+		log.Ctx(c).Err(err).Caller().Msg("failed to insert partner")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	event := models.NewAuditEvent(models.AuditPartnerCreated, actorID(c), 0)
+	event.Details["partner_id"] = partner.ID
+	event.Details["name"] = partner.Name
+	recordAudit(c.Request.Context(), event)
+	c.JSON(http.StatusCreated, partner)
+}
+
+func (g *Gophermart) adminListAPIKeys(c *gin.Context) {
+	partner, ok := partnerFromParam(c)
+	if !ok {
+		return
+	}
+
+	keys, err := partner.GetAPIKeys(c.Request.Context())
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to fetch api keys")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+type issueAPIKeyRequest struct {
+	Scopes []string `json:"scopes" binding:"required,min=1"`
+}
+
+func (g *Gophermart) adminIssueAPIKey(c *gin.Context) {
+	var jsonRequest issueAPIKeyRequest
+
+	if err := c.Bind(&jsonRequest); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, scope := range jsonRequest.Scopes {
+		if !models.IsValidScope(scope) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown scope " + scope})
+			return
+		}
+	}
+
+	partner, ok := partnerFromParam(c)
+	if !ok {
+		return
+	}
+
+	apiKey, rawKey, err := partner.IssueAPIKey(c.Request.Context(), jsonRequest.Scopes)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to issue api key")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	event := models.NewAuditEvent(models.AuditAPIKeyIssued, actorID(c), 0)
+	event.Details["partner_id"] = partner.ID
+	event.Details["key_id"] = apiKey.ID
+	event.Details["prefix"] = apiKey.Prefix
+	event.Details["scopes"] = apiKey.Scopes
+	recordAudit(c.Request.Context(), event)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"key":     rawKey,
+		"api_key": apiKey,
+	})
+}
+
+func (g *Gophermart) adminRevokeAPIKey(c *gin.Context) {
+	partner, ok := partnerFromParam(c)
+	if !ok {
+		return
+	}
+
+	keyID, err := strconv.Atoi(c.Param("key_id"))
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	revoked, err := partner.RevokeAPIKey(c.Request.Context(), keyID)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to revoke api key")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !revoked {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	event := models.NewAuditEvent(models.AuditAPIKeyRevoked, actorID(c), 0)
+	event.Details["partner_id"] = partner.ID
+	event.Details["key_id"] = keyID
+	recordAudit(c.Request.Context(), event)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,234 @@
+package gophermart
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/shopspring/decimal"
+
+	"github.com/kazauwa/gophermart/internal/models"
+)
+
+func (g *Gophermart) setupTwoFactor(c *gin.Context) {
+	userValue, _ := c.Get("user")
+	currentUser, ok := userValue.(*models.User)
+	if !ok {
+		log.Ctx(c).Error().Caller().Msg("malformed user in session")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	uri, recoveryCodes, err := currentUser.SetupTOTP(c.Request.Context(), g.cfg.TwoFactor.Issuer)
+	switch {
+	case errors.Is(err, models.ErrTwoFactorAlreadyEnabled):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+
+	case err != nil:
+		log.Ctx(c).Err(err).Caller().Msg("failed to set up two-factor authentication")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"otpauth_uri":    uri,
+		"recovery_codes": recoveryCodes,
+	})
+}
+
+type twoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+func (g *Gophermart) enableTwoFactor(c *gin.Context) {
+	userValue, _ := c.Get("user")
+	currentUser, ok := userValue.(*models.User)
+	if !ok {
+		log.Ctx(c).Error().Caller().Msg("malformed user in session")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var jsonRequest twoFactorCodeRequest
+
+	if err := c.Bind(&jsonRequest); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ok, err := currentUser.EnableTOTP(c.Request.Context(), jsonRequest.Code)
+	switch {
+	case errors.Is(err, models.ErrTwoFactorAlreadyEnabled):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+
+	case errors.Is(err, models.ErrTwoFactorNotSetUp):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+
+	case err != nil:
+		log.Ctx(c).Err(err).Caller().Msg("failed to enable two-factor authentication")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+
+	case !ok:
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid code"})
+		return
+	}
+
+	recordAudit(c.Request.Context(), models.NewAuditEvent(models.AuditTwoFactorEnabled, currentUser.ID, currentUser.ID))
+	c.Status(http.StatusOK)
+}
+
+// issueLoginChallenge asks for the second factor. passwordRehash, if set, is
+// saved once the challenge is completed.
+func (g *Gophermart) issueLoginChallenge(
+	c *gin.Context,
+	user *models.User,
+	issueTokens bool,
+	passwordRehash string,
+) {
+	challenge := models.NewLoginChallenge(user.ID, issueTokens)
+	challenge.PasswordRehash = passwordRehash
+	token, err := challenge.Insert(c.Request.Context(), g.cfg.TwoFactor.ChallengeTTL)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to create login challenge")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"two_factor_required": true,
+		"challenge":           token,
+	})
+}
+
+type loginChallengeRequest struct {
+	Challenge string `json:"challenge" binding:"required"`
+	Code      string `json:"code" binding:"required"`
+}
+
+func (g *Gophermart) completeLoginChallenge(c *gin.Context) {
+	ctx := c.Request.Context()
+	var jsonRequest loginChallengeRequest
+
+	if err := c.Bind(&jsonRequest); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	challenge := &models.LoginChallenge{}
+	err := challenge.GetActiveByToken(ctx, jsonRequest.Challenge)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid challenge"})
+		return
+
+	case err != nil:
+		log.Ctx(c).Err(err).Caller().Msg("failed to fetch login challenge")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	user := models.NewUser()
+	if err := user.GetByID(ctx, challenge.UserID); err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to fetch user")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	clientIP := c.ClientIP()
+	if retryAfter := g.acquireLoginAttempt(user.Login, clientIP); retryAfter > 0 {
+		auditLoginFailure(ctx, user.ID, user.Login, "locked out")
+		abortLockedOut(c, retryAfter)
+		return
+	}
+
+	ok, err := user.VerifyTOTP(ctx, jsonRequest.Code)
+	if err == nil && !ok {
+		ok, err = user.ConsumeRecoveryCode(ctx, jsonRequest.Code)
+	}
+
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("failed to verify two-factor code")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !ok {
+		g.recordLoginFailure(c.Request.Context(), user.ID, user.Login, clientIP, "invalid two-factor code")
+		if err := challenge.RecordFailure(ctx, g.cfg.TwoFactor.MaxAttempts); err != nil {
+			log.Ctx(c).Err(err).Caller().Msg("failed to record challenge failure")
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+		return
+	}
+
+	completed, err := challenge.Complete(ctx)
+	switch {
+	case err != nil:
+		log.Ctx(c).Err(err).Caller().Msg("failed to complete login challenge")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+
+	case !completed:
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid challenge"})
+		return
+	}
+
+	g.ipLockout.Release(clientIP)
+	g.savePasswordRehash(ctx, user, challenge.PasswordRehash)
+	g.completeLogin(c, user, challenge.IssueTokens)
+}
+
+// checkWithdrawalCode requires a fresh TOTP code for large withdrawals from
+// accounts with two-factor authentication enabled. Wrong codes count towards a
+// per-user lockout so the code cannot be guessed across withdrawals. It writes
+// the error response itself and reports whether the withdrawal may proceed.
+func (g *Gophermart) checkWithdrawalCode(
+	c *gin.Context,
+	user *models.User,
+	sum decimal.Decimal,
+	code string,
+) bool {
+	if !user.TOTPEnabled || !sum.GreaterThan(g.cfg.TwoFactor.WithdrawThreshold) {
+		return true
+	}
+
+	if code == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "two-factor code required"})
+		return false
+	}
+
+	key := strconv.Itoa(user.ID)
+	if retryAfter := g.twoFactorLockout.Acquire(key); retryAfter > 0 {
+		log.Ctx(c).Warn().
+			Int("user_id", user.ID).
+			Dur("lockout", retryAfter).
+			Msg("two-factor attempt during lockout")
+		abortTooManyAttempts(c, retryAfter, "too many two-factor attempts")
+		return false
+	}
+
+	ok, err := user.VerifyTOTP(c.Request.Context(), code)
+	if err != nil {
+		g.twoFactorLockout.Release(key)
+		log.Ctx(c).Err(err).Caller().Msg("failed to verify two-factor code")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return false
+	}
+
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid two-factor code"})
+		return false
+	}
+
+	g.twoFactorLockout.Reset(key)
+	return true
+}
@@ -0,0 +1,87 @@
+package gophermart
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"github.com/shopspring/decimal"
+
+	"github.com/kazauwa/gophermart/internal/models"
+	"github.com/kazauwa/gophermart/internal/storage/storagetest"
+)
+
+// newTOTPUser inserts a user with two-factor authentication enabled.
+func newTOTPUser(t *testing.T) *models.User {
+	t.Helper()
+	ctx := context.Background()
+
+	user := models.NewUser()
+	user.Login = "totp_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	user.SetPasswordHash("hash")
+	if err := user.Insert(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	uri, _, err := user.SetupTOTP(ctx, "Gophermart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := otp.NewKeyFromURL(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.GenerateCode(key.Secret(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := user.EnableTOTP(ctx, code); err != nil || !ok {
+		t.Fatalf("enable two-factor: ok=%v, err=%v", ok, err)
+	}
+	return user
+}
+
+func TestCheckWithdrawalCodeLocksOutGuessing(t *testing.T) {
+	storagetest.Require(t)
+	gin.SetMode(gin.TestMode)
+
+	cfg := NewConfig()
+	g := &Gophermart{
+		cfg: cfg,
+		twoFactorLockout: newLockoutTracker(
+			cfg.TwoFactor.MaxAttempts, time.Minute, time.Hour,
+		),
+	}
+	user := newTOTPUser(t)
+	sum := cfg.TwoFactor.WithdrawThreshold.Add(decimal.NewFromInt(1))
+
+	check := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", nil)
+		if g.checkWithdrawalCode(c, user, sum, "000000") {
+			t.Fatal("a wrong code was accepted")
+		}
+		return recorder
+	}
+
+	for i := 0; i < cfg.TwoFactor.MaxAttempts; i++ {
+		if recorder := check(); recorder.Code != http.StatusForbidden {
+			t.Fatalf("attempt %d: got status %d, want %d", i+1, recorder.Code, http.StatusForbidden)
+		}
+	}
+
+	recorder := check()
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want %d", recorder.Code, http.StatusTooManyRequests)
+	}
+	if recorder.Header().Get("Retry-After") == "" {
+		t.Error("Retry-After header is missing")
+	}
+}
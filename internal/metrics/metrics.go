@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/shopspring/decimal"
+)
+
+const namespace = "gophermart"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests processed, by route and status code.",
+	}, []string{"method", "route", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency, by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	accrualRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "accrual_requests_total",
+		Help:      "Requests made to the accrual system, by response code.",
+	}, []string{"code", "method"})
+
+	pollerBacklog = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "poller_backlog_orders",
+		Help:      "Orders waiting for accrual at the last poller tick.",
+	})
+
+	deposited = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deposited_points_total",
+		Help:      "Loyalty points credited to user balances.",
+	})
+
+	withdrawn = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "withdrawn_points_total",
+		Help:      "Loyalty points withdrawn from user balances.",
+	})
+)
+
+// NewServer returns a server exposing /metrics on addr. It is meant for a
+// listener that only the monitoring system can reach, apart from the API.
+func NewServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+func Middleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+
+	method := c.Request.Method
+	httpRequests.WithLabelValues(method, route, strconv.Itoa(c.Writer.Status())).Inc()
+	httpDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+}
+
+func InstrumentAccrualTransport(transport http.RoundTripper) http.RoundTripper {
+	return promhttp.InstrumentRoundTripperCounter(accrualRequests, transport)
+}
+
+func SetPollerBacklog(size int) {
+	pollerBacklog.Set(float64(size))
+}
+
+func AddDeposit(sum decimal.Decimal) {
+	deposited.Add(sum.InexactFloat64())
+}
+
+func AddWithdrawal(sum decimal.Decimal) {
+	withdrawn.Add(sum.InexactFloat64())
+}
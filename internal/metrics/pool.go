@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type poolCollector struct {
+	pool *pgxpool.Pool
+
+	acquiredConns   *prometheus.Desc
+	idleConns       *prometheus.Desc
+	totalConns      *prometheus.Desc
+	maxConns        *prometheus.Desc
+	acquireCount    *prometheus.Desc
+	emptyAcquires   *prometheus.Desc
+	acquireDuration *prometheus.Desc
+}
+
+func newPoolDesc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", name), help, nil, nil)
+}
+
+func RegisterPool(pool *pgxpool.Pool) error {
+	return prometheus.Register(&poolCollector{
+		pool:            pool,
+		acquiredConns:   newPoolDesc("acquired_connections", "Connections currently acquired."),
+		idleConns:       newPoolDesc("idle_connections", "Idle connections in the pool."),
+		totalConns:      newPoolDesc("total_connections", "Total connections in the pool."),
+		maxConns:        newPoolDesc("max_connections", "Maximum size of the pool."),
+		acquireCount:    newPoolDesc("acquires_total", "Successful connection acquires."),
+		emptyAcquires:   newPoolDesc("empty_acquires_total", "Acquires that had to wait for a connection."),
+		acquireDuration: newPoolDesc("acquire_wait_seconds_total", "Time spent acquiring connections."),
+	})
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.acquiredConns
+	ch <- c.idleConns
+	ch <- c.totalConns
+	ch <- c.maxConns
+	ch <- c.acquireCount
+	ch <- c.emptyAcquires
+	ch <- c.acquireDuration
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := c.pool.Stat()
+	ch <- prometheus.MustNewConstMetric(c.acquiredConns, prometheus.GaugeValue, float64(stat.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(c.idleConns, prometheus.GaugeValue, float64(stat.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(c.totalConns, prometheus.GaugeValue, float64(stat.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(c.maxConns, prometheus.GaugeValue, float64(stat.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(c.acquireCount, prometheus.CounterValue, float64(stat.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.emptyAcquires, prometheus.CounterValue, float64(stat.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(
+		c.acquireDuration, prometheus.CounterValue, stat.AcquireDuration().Seconds(),
+	)
+}
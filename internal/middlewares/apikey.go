@@ -0,0 +1,57 @@
+package middlewares
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.com/kazauwa/gophermart/internal/models"
+)
+
+const APIKeyHeader = "X-API-Key"
+
+func APIKeyRequired(scope models.APIKeyScope) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rawKey := c.GetHeader(APIKeyHeader)
+		if rawKey == "" {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		apiKey := &models.APIKey{}
+		err := apiKey.Authenticate(c.Request.Context(), rawKey)
+		switch {
+		case errors.Is(err, models.ErrInvalidAPIKey), errors.Is(err, pgx.ErrNoRows):
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+
+		case err != nil:
+			log.Ctx(c).Err(err).Caller().Msg("failed to authenticate api key")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		if !apiKey.HasScope(scope) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		partner := &models.Partner{}
+		if err := partner.GetByID(c.Request.Context(), apiKey.PartnerID); err != nil {
+			log.Ctx(c).Err(err).Caller().Msg("failed to fetch partner")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.Set("api_key", apiKey)
+		c.Set("partner", partner)
+		annotateLogger(c, func(l zerolog.Context) zerolog.Context {
+			return l.Int("partner_id", partner.ID)
+		})
+		c.Next()
+	}
+}
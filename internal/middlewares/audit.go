@@ -0,0 +1,18 @@
+package middlewares
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/kazauwa/gophermart/internal/models"
+)
+
+// AuditRequest attaches the client IP and user agent to the request context,
+// so audit events recorded while handling the request carry them.
+func AuditRequest(c *gin.Context) {
+	ctx := models.WithAuditRequest(c.Request.Context(), models.AuditRequest{
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	})
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+}
@@ -3,37 +3,131 @@ package middlewares
 import (
 	"errors"
 	"net/http"
+	"strings"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 
 	"github.com/kazauwa/gophermart/internal/models"
+	"github.com/kazauwa/gophermart/internal/tokens"
 )
 
+const (
+	SessionTokenKey = "sid"
+	keySetKey       = "github.com/kazauwa/gophermart/internal/middlewares/keyset"
+)
+
+func BearerTokens(keySet *tokens.KeySet) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(keySetKey, keySet)
+		c.Next()
+	}
+}
+
+func bearerToken(c *gin.Context) (string, bool) {
+	header := c.GetHeader("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")), true
+}
+
+func authenticateBearer(c *gin.Context, token string) {
+	// Routers without BearerTokens, or with token authentication disabled,
+	// reject bearer tokens as invalid credentials.
+	value, _ := c.Get(keySetKey)
+	keySet, _ := value.(*tokens.KeySet)
+	if keySet == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := keySet.ParseAccessToken(token)
+	if err != nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	user := models.NewUser()
+	err = user.GetByID(c.Request.Context(), userID)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+
+	case err != nil:
+		log.Ctx(c).Err(err).Caller().Msg("failed to authenticate request")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if user.Blocked {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "account is blocked"})
+		return
+	}
+
+	c.Set("user", user)
+	annotateLogger(c, func(l zerolog.Context) zerolog.Context {
+		return l.Int("user_id", user.ID)
+	})
+	c.Next()
+}
+
 func AuthRequired(c *gin.Context) {
+	if token, ok := bearerToken(c); ok {
+		authenticateBearer(c, token)
+		return
+	}
+
 	session := sessions.Default(c)
-	sessionValue := session.Get("user")
-	userID, ok := sessionValue.(int)
+	sessionValue := session.Get(SessionTokenKey)
+	token, ok := sessionValue.(string)
 	if sessionValue == nil || !ok {
-		session.Delete("user")
+		session.Delete(SessionTokenKey)
 		c.AbortWithStatus(http.StatusUnauthorized)
 		return
 	}
 
+	userSession := &models.Session{}
+	err := userSession.GetActiveByToken(c.Request.Context(), token)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		session.Delete(SessionTokenKey)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+
+	case err != nil:
+		log.Ctx(c).Err(err).Caller().Msg("failed to authenticate request")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
 	user := models.NewUser()
-	err := user.GetByID(c.Request.Context(), userID)
+	err = user.GetByID(c.Request.Context(), userSession.UserID)
 	switch {
 	case errors.Is(err, pgx.ErrNoRows):
-		session.Delete("user")
+		session.Delete(SessionTokenKey)
 		c.AbortWithStatus(http.StatusUnauthorized)
 		return
 
 	case err != nil:
+		log.Ctx(c).Err(err).Caller().Msg("failed to authenticate request")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
+	c.Set("session", userSession)
+	if user.Blocked {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "account is blocked"})
+		return
+	}
+
 	c.Set("user", user)
+	annotateLogger(c, func(l zerolog.Context) zerolog.Context {
+		return l.Int("user_id", user.ID)
+	})
 	c.Next()
 }
@@ -0,0 +1,18 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ClientCertRequired only lets through requests that presented a client
+// certificate verified against the configured client CA (mTLS). It is meant
+// for internal endpoints, such as callbacks from other services.
+func ClientCertRequired(c *gin.Context) {
+	if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "client certificate required"})
+		return
+	}
+	c.Next()
+}
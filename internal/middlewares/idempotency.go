@@ -0,0 +1,144 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog/log"
+
+	"github.com/kazauwa/gophermart/internal/models"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	idempotencyKeyTTL    = 24 * time.Hour
+	idempotencyKeyLease  = time.Minute
+	maxIdempotencyKeyLen = 255
+)
+
+// idempotencyStoreTimeout bounds storing the outcome once the handler is done,
+// independently of the request.
+const idempotencyStoreTimeout = 5 * time.Second
+
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+func hashRequest(c *gin.Context, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(c.Request.Method))
+	hash.Write([]byte(c.FullPath()))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func Idempotent(c *gin.Context) {
+	key := c.GetHeader(IdempotencyKeyHeader)
+	if key == "" {
+		c.Next()
+		return
+	}
+
+	if len(key) > maxIdempotencyKeyLen {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "idempotency key is too long"})
+		return
+	}
+
+	userValue, _ := c.Get("user")
+	currentUser, ok := userValue.(*models.User)
+	if !ok {
+		log.Ctx(c).Error().Caller().Msg("malformed user in session")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("error parsing input")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	ctx := c.Request.Context()
+	notBefore := time.Now().Add(-idempotencyKeyTTL)
+	idempotencyKey := models.NewIdempotencyKey(currentUser.ID, key)
+	idempotencyKey.RequestHash = hashRequest(c, body)
+	idempotencyKey.LockedUntil = idempotencyKey.CreatedAt.Add(idempotencyKeyLease)
+
+	reserved, err := idempotencyKey.Reserve(ctx, notBefore)
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("cannot reserve idempotency key")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !reserved {
+		stored := models.NewIdempotencyKey(currentUser.ID, key)
+		err = stored.Get(ctx, notBefore)
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "request is being processed"})
+
+		case err != nil:
+			log.Ctx(c).Err(err).Caller().Msg("cannot fetch idempotency key")
+			c.AbortWithStatus(http.StatusInternalServerError)
+
+		case stored.RequestHash != idempotencyKey.RequestHash:
+			c.AbortWithStatusJSON(
+				http.StatusUnprocessableEntity,
+				gin.H{"error": "idempotency key was used with a different request"},
+			)
+
+		case !stored.IsCompleted():
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "request is being processed"})
+
+		default:
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(*stored.StatusCode, stored.ContentType, stored.Response)
+			c.Abort()
+		}
+		return
+	}
+
+	writer := &recordingWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+	c.Next()
+
+	// A client that timed out is the one that will retry, so the outcome is
+	// stored even when the request context is already cancelled.
+	storeCtx, cancel := context.WithTimeout(log.Ctx(ctx).WithContext(context.Background()), idempotencyStoreTimeout)
+	defer cancel()
+
+	status := writer.Status()
+	if status >= http.StatusInternalServerError {
+		if err := idempotencyKey.Delete(storeCtx); err != nil {
+			log.Ctx(c).Err(err).Caller().Msg("cannot release idempotency key")
+		}
+		return
+	}
+
+	err = idempotencyKey.SaveResponse(storeCtx, status, writer.Header().Get("Content-Type"), writer.body.Bytes())
+	if err != nil {
+		log.Ctx(c).Err(err).Caller().Msg("cannot save idempotent response")
+	}
+}
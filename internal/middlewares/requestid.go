@@ -0,0 +1,88 @@
+package middlewares
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	RequestIDHeader    = "X-Request-ID"
+	RequestIDKey       = "request_id"
+	loggerKey          = "github.com/kazauwa/gophermart/internal/middlewares/logger"
+	maxRequestIDLength = 128
+)
+
+// RequestID accepts the caller's X-Request-ID or generates a new one, echoes
+// it in the response and stores a request-scoped logger in the request
+// context, so handlers can log through log.Ctx.
+func RequestID(c *gin.Context) {
+	requestID := c.GetHeader(RequestIDHeader)
+	if !isValidRequestID(requestID) {
+		requestID = newRequestID()
+	}
+	c.Header(RequestIDHeader, requestID)
+	c.Set(RequestIDKey, requestID)
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	logger := log.With().
+		Str("request_id", requestID).
+		Str("route", route).
+		Str("ip", c.ClientIP()).
+		Logger()
+	ctx := logger.WithContext(c.Request.Context())
+	c.Set(loggerKey, zerolog.Ctx(ctx))
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+}
+
+// AccessLogger builds the access log entry for gin-contrib/logger on top of
+// the request-scoped logger.
+func AccessLogger(c *gin.Context, _ io.Writer, latency time.Duration) zerolog.Logger {
+	return log.Ctx(c.Request.Context()).With().
+		Int("status", c.Writer.Status()).
+		Str("method", c.Request.Method).
+		Str("path", c.Request.URL.Path).
+		Dur("latency", latency).
+		Str("user_agent", c.Request.UserAgent()).
+		Logger()
+}
+
+// annotateLogger adds fields to the request-scoped logger once they become
+// known, e.g. the user id after authentication.
+func annotateLogger(c *gin.Context, update func(zerolog.Context) zerolog.Context) {
+	value, ok := c.Get(loggerKey)
+	if !ok {
+		return
+	}
+	value.(*zerolog.Logger).UpdateContext(update)
+}
+
+func isValidRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range requestID {
+		if r < '!' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,36 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	"github.com/kazauwa/gophermart/internal/models"
+)
+
+func RequireRole(roles ...models.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userValue, _ := c.Get("user")
+		currentUser, ok := userValue.(*models.User)
+		if !ok {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		if !currentUser.HasRole(roles...) {
+			log.Ctx(c).Warn().
+				Int("user_id", currentUser.ID).
+				Str("role", currentUser.Role).
+				Str("path", c.FullPath()).
+				Msg("access denied")
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		c.Next()
+	}
+}
+
+func RequirePermission(permission models.Permission) gin.HandlerFunc {
+	return RequireRole(models.Policy[permission]...)
+}
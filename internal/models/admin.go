@@ -0,0 +1,191 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/shopspring/decimal"
+
+	"github.com/kazauwa/gophermart/internal/storage"
+)
+
+var ErrNegativeBalance = errors.New("adjustment would make balance negative")
+
+// likeEscaper makes user input match literally in LIKE patterns, which use
+// backslash as the default escape character.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+type BalanceAdjustment struct {
+	ID        int             `json:"id"`
+	UserID    int             `json:"user_id"`
+	ActorID   int             `json:"actor_id"`
+	Amount    decimal.Decimal `json:"amount"`
+	Reason    string          `json:"reason"`
+	Balance   decimal.Decimal `json:"balance"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+func (a *BalanceAdjustment) MarshalJSON() ([]byte, error) {
+	type shadowBalanceAdjustment BalanceAdjustment
+	return json.Marshal(&struct {
+		CreatedAt string `json:"created_at"`
+		*shadowBalanceAdjustment
+	}{
+		CreatedAt:               a.CreatedAt.Format(time.RFC3339),
+		shadowBalanceAdjustment: (*shadowBalanceAdjustment)(a),
+	})
+}
+
+func SearchUsers(ctx context.Context, login string, limit int) ([]*User, error) {
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	users := make([]*User, 0)
+	query := selectUserQuery + ` WHERE login ILIKE '%' || $1 || '%' ORDER BY login LIMIT $2`
+	rows, err := db.Pool.Query(ctx, query, likeEscaper.Replace(login), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		u := NewUser()
+		if err = rows.Scan(u.scanDest()...); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+// SetBlocked blocks or unblocks the user on behalf of actorID. Blocking also
+// revokes every session and refresh token of the user.
+func (u *User) SetBlocked(ctx context.Context, blocked bool, actorID int) error {
+	db := storage.GetDB()
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	var rollbackErr error
+	defer func() {
+		rollbackErr = tx.Rollback(ctx)
+	}()
+
+	now := time.Now()
+	action := AuditUserUnblocked
+	updateQuery := "UPDATE users SET blocked_at = NULL WHERE id = $1"
+	args := []interface{}{u.ID}
+	if blocked {
+		action = AuditUserBlocked
+		updateQuery = "UPDATE users SET blocked_at = $2 WHERE id = $1"
+		args = append(args, now)
+	}
+
+	if _, err = tx.Exec(ctx, updateQuery, args...); err != nil {
+		return err
+	}
+
+	if blocked {
+		sessionsQuery := "UPDATE user_sessions SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL"
+		if _, err = tx.Exec(ctx, sessionsQuery, now, u.ID); err != nil {
+			return err
+		}
+
+		tokensQuery := "UPDATE refresh_tokens SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL"
+		if _, err = tx.Exec(ctx, tokensQuery, now, u.ID); err != nil {
+			return err
+		}
+	}
+
+	if err = NewAuditEvent(action, actorID, u.ID).insert(ctx, tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	u.Blocked = blocked
+	return rollbackErr
+}
+
+// AdjustBalance credits (positive amount) or debits (negative amount) the
+// user's balance, recording the adjustment and an audit event atomically.
+func (u *User) AdjustBalance(
+	ctx context.Context,
+	amount decimal.Decimal,
+	reason string,
+	actorID int,
+) (*BalanceAdjustment, error) {
+	if amount.IsZero() {
+		return nil, errors.New("incorrect adjustment amount")
+	}
+
+	db := storage.GetDB()
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rollbackErr error
+	defer func() {
+		rollbackErr = tx.Rollback(ctx)
+	}()
+
+	adjustment := &BalanceAdjustment{
+		UserID:  u.ID,
+		ActorID: actorID,
+		Amount:  amount,
+		Reason:  reason,
+	}
+
+	updateQuery := `UPDATE users SET balance = balance + $1
+		WHERE id = $2 AND balance + $1 >= 0
+		RETURNING balance`
+	err = tx.QueryRow(ctx, updateQuery, amount, u.ID).Scan(&adjustment.Balance)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, ErrNegativeBalance
+
+	case err != nil:
+		return nil, err
+	}
+
+	insertQuery := `INSERT INTO balance_adjustments (user_id, actor_id, amount, reason)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`
+	err = tx.QueryRow(ctx, insertQuery, u.ID, actorID, amount, reason).Scan(
+		&adjustment.ID, &adjustment.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	event := NewAuditEvent(AuditBalanceAdjustment, actorID, u.ID)
+	event.Details["adjustment_id"] = adjustment.ID
+	event.Details["amount"] = amount.String()
+	event.Details["reason"] = reason
+	event.Details["balance"] = adjustment.Balance.String()
+	if err = event.insert(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	u.Balance = adjustment.Balance
+	return adjustment, rollbackErr
+}
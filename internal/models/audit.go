@@ -0,0 +1,196 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/kazauwa/gophermart/internal/storage"
+)
+
+type AuditAction = string
+
+const (
+	AuditUserBlocked       AuditAction = "user.blocked"
+	AuditUserUnblocked     AuditAction = "user.unblocked"
+	AuditBalanceAdjustment AuditAction = "balance.adjusted"
+	AuditUserDeleted       AuditAction = "user.deleted"
+	AuditUserRegistered    AuditAction = "user.registered"
+	AuditLoginSucceeded    AuditAction = "login.succeeded"
+	AuditLoginFailed       AuditAction = "login.failed"
+	AuditSessionRevoked    AuditAction = "session.revoked"
+	AuditWithdrawal        AuditAction = "balance.withdrawn"
+	AuditDeposit           AuditAction = "balance.deposited"
+	AuditPasswordChanged   AuditAction = "password.changed"
+	AuditPasswordReset     AuditAction = "password.reset"
+	AuditTwoFactorEnabled  AuditAction = "two_factor.enabled"
+	AuditIdentityLinked    AuditAction = "identity.linked"
+	AuditPartnerCreated    AuditAction = "partner.created"
+	AuditAPIKeyIssued      AuditAction = "api_key.issued"
+	AuditAPIKeyRevoked     AuditAction = "api_key.revoked"
+	AuditCustomerLinked    AuditAction = "partner_customer.linked"
+)
+
+type auditRequestKey struct{}
+
+// AuditRequest describes the client that triggered an audited action.
+type AuditRequest struct {
+	IP        string
+	UserAgent string
+}
+
+// WithAuditRequest attaches the client details to ctx so that every audit
+// event recorded with it carries the caller's IP and user agent.
+func WithAuditRequest(ctx context.Context, request AuditRequest) context.Context {
+	return context.WithValue(ctx, auditRequestKey{}, request)
+}
+
+type AuditEvent struct {
+	ID        int64                  `json:"id"`
+	ActorID   *int                   `json:"actor_id,omitempty"`
+	UserID    *int                   `json:"user_id,omitempty"`
+	Action    AuditAction            `json:"action"`
+	IP        string                 `json:"ip,omitempty"`
+	UserAgent string                 `json:"user_agent,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+func NewAuditEvent(action AuditAction, actorID, userID int) *AuditEvent {
+	event := &AuditEvent{
+		Action:    action,
+		Details:   make(map[string]interface{}),
+		CreatedAt: time.Now(),
+	}
+
+	if actorID != 0 {
+		event.ActorID = &actorID
+	}
+	if userID != 0 {
+		event.UserID = &userID
+	}
+	return event
+}
+
+func (e *AuditEvent) MarshalJSON() ([]byte, error) {
+	type shadowAuditEvent AuditEvent
+	return json.Marshal(&struct {
+		CreatedAt string `json:"created_at"`
+		*shadowAuditEvent
+	}{
+		CreatedAt:        e.CreatedAt.Format(time.RFC3339),
+		shadowAuditEvent: (*shadowAuditEvent)(e),
+	})
+}
+
+// Record stores an audit event outside of any other transaction. Events that
+// accompany a data change are written by the model within the same
+// transaction instead.
+func (e *AuditEvent) Record(ctx context.Context) error {
+	db := storage.GetDB()
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	var rollbackErr error
+	defer func() {
+		rollbackErr = tx.Rollback(ctx)
+	}()
+
+	if err = e.insert(ctx, tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	return rollbackErr
+}
+
+func (e *AuditEvent) insert(ctx context.Context, tx pgx.Tx) error {
+	if request, ok := ctx.Value(auditRequestKey{}).(AuditRequest); ok {
+		e.IP = request.IP
+		e.UserAgent = request.UserAgent
+	}
+
+	details, err := json.Marshal(e.Details)
+	if err != nil {
+		return err
+	}
+
+	insertQuery := `INSERT INTO audit_events (
+		actor_id, user_id, action, ip, user_agent, details, created_at
+	  )
+	  VALUES
+		($1, $2, $3, $4, $5, $6, $7)
+	  RETURNING id`
+	return tx.QueryRow(
+		ctx, insertQuery, e.ActorID, e.UserID, e.Action, e.IP, e.UserAgent, details, e.CreatedAt,
+	).Scan(&e.ID)
+}
+
+// GetAuditEvents returns events newest first, optionally narrowed to a single
+// user (as subject or actor) and to the [from, to) time range.
+func GetAuditEvents(ctx context.Context, userID int, from, to time.Time, limit int) ([]*AuditEvent, error) {
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	conditions := make([]string, 0, 3)
+	args := make([]interface{}, 0, 4)
+	if userID != 0 {
+		args = append(args, userID)
+		conditions = append(conditions, fmt.Sprintf("(user_id = $%d OR actor_id = $%[1]d)", len(args)))
+	}
+	if !from.IsZero() {
+		args = append(args, from)
+		conditions = append(conditions, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+	if !to.IsZero() {
+		args = append(args, to)
+		conditions = append(conditions, fmt.Sprintf("created_at < $%d", len(args)))
+	}
+
+	query := `SELECT id, actor_id, user_id, action, coalesce(ip, ''), coalesce(user_agent, ''),
+		details, created_at
+		FROM audit_events`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, limit)
+	query += fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d", len(args))
+
+	rows, err := db.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*AuditEvent, 0)
+	for rows.Next() {
+		event := &AuditEvent{}
+		var details []byte
+		err = rows.Scan(
+			&event.ID, &event.ActorID, &event.UserID, &event.Action,
+			&event.IP, &event.UserAgent, &details, &event.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if len(details) > 0 {
+			if err = json.Unmarshal(details, &event.Details); err != nil {
+				return nil, err
+			}
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
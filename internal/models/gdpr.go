@@ -0,0 +1,167 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/kazauwa/gophermart/internal/storage"
+)
+
+// AnonymousLoginPrefix starts the login of every erased account. It is
+// reserved, so nobody can register a login that an erasure would need.
+const AnonymousLoginPrefix = "deleted_"
+
+// IsReservedLogin reports whether login cannot be taken by a new account.
+func IsReservedLogin(login string) bool {
+	return strings.HasPrefix(strings.ToLower(login), AnonymousLoginPrefix)
+}
+
+type BalanceEntryKind = string
+
+const (
+	BalanceEntryDeposit    BalanceEntryKind = "deposit"
+	BalanceEntryWithdrawal BalanceEntryKind = "withdrawal"
+	BalanceEntryAdjustment BalanceEntryKind = "adjustment"
+)
+
+type BalanceEntry struct {
+	Kind       BalanceEntryKind `json:"kind"`
+	OrderID    string           `json:"order,omitempty"`
+	Amount     decimal.Decimal  `json:"amount"`
+	Reason     string           `json:"reason,omitempty"`
+	OccurredAt time.Time        `json:"occurred_at"`
+}
+
+func (e *BalanceEntry) MarshalJSON() ([]byte, error) {
+	type shadowBalanceEntry BalanceEntry
+	return json.Marshal(&struct {
+		OccurredAt string `json:"occurred_at"`
+		*shadowBalanceEntry
+	}{
+		OccurredAt:         e.OccurredAt.Format(time.RFC3339),
+		shadowBalanceEntry: (*shadowBalanceEntry)(e),
+	})
+}
+
+func (u *User) GetBalanceHistory(ctx context.Context) ([]*BalanceEntry, error) {
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	entries := make([]*BalanceEntry, 0)
+	query := `SELECT 'deposit', o.id, o.accrual, '', coalesce(max(h.changed_at), o.uploaded_at)
+			FROM orders o
+			LEFT JOIN order_status_history h ON h.order_id = o.id AND h.status = 'PROCESSED'
+			WHERE o.user_id = $1 AND o.status = 'PROCESSED'
+			GROUP BY o.id
+		UNION ALL
+		SELECT 'withdrawal', order_id, -amount, '', processed_at
+			FROM withdrawals
+			WHERE user_id = $1
+		UNION ALL
+		SELECT 'adjustment', '', amount, reason, created_at
+			FROM balance_adjustments
+			WHERE user_id = $1
+		ORDER BY 5`
+	rows, err := db.Pool.Query(ctx, query, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := &BalanceEntry{}
+		if err = rows.Scan(&e.Kind, &e.OrderID, &e.Amount, &e.Reason, &e.OccurredAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Anonymize erases personal data of the user, including the client IPs and
+// user agents in their audit events, while keeping orders, withdrawals and
+// balance adjustments that must be retained by law. The
+// password must be set to an unusable value beforehand.
+func (u *User) Anonymize(ctx context.Context) error {
+	db := storage.GetDB()
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	var rollbackErr error
+	defer func() {
+		rollbackErr = tx.Rollback(ctx)
+	}()
+
+	// The random suffix keeps erasure from colliding with accounts that took
+	// a reserved login before it was reserved.
+	suffix := make([]byte, 4)
+	if _, err = rand.Read(suffix); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	anonymousLogin := fmt.Sprintf("%s%d_%s", AnonymousLoginPrefix, u.ID, hex.EncodeToString(suffix))
+	updateQuery := `UPDATE users
+		SET login = $1, password = $2, totp_secret = NULL, totp_enabled = false,
+			role = 'user', blocked_at = $3, deleted_at = $3
+		WHERE id = $4`
+	if _, err = tx.Exec(ctx, updateQuery, anonymousLogin, u.password, now, u.ID); err != nil {
+		return err
+	}
+
+	cleanupQueries := []string{
+		"DELETE FROM user_sessions WHERE user_id = $1",
+		"DELETE FROM refresh_tokens WHERE user_id = $1",
+		"DELETE FROM password_reset_tokens WHERE user_id = $1",
+		"DELETE FROM recovery_codes WHERE user_id = $1",
+		"DELETE FROM login_challenges WHERE user_id = $1",
+		"DELETE FROM idempotency_keys WHERE user_id = $1",
+		"DELETE FROM user_identities WHERE user_id = $1",
+		"DELETE FROM partner_customers WHERE user_id = $1",
+		"DELETE FROM partner_link_tokens WHERE user_id = $1",
+	}
+	for _, query := range cleanupQueries {
+		if _, err = tx.Exec(ctx, query, u.ID); err != nil {
+			return err
+		}
+	}
+
+	if err = NewAuditEvent(AuditUserDeleted, u.ID, u.ID).insert(ctx, tx); err != nil {
+		return err
+	}
+
+	// The audit log only accepts updates that erase client details, and only
+	// while gophermart.audit_scrub is set.
+	if _, err = tx.Exec(ctx, "SET LOCAL gophermart.audit_scrub = 'on'"); err != nil {
+		return err
+	}
+
+	scrubQuery := `UPDATE audit_events SET ip = NULL, user_agent = NULL, details = details - 'login'
+		WHERE user_id = $1 OR actor_id = $1`
+	if _, err = tx.Exec(ctx, scrubQuery, u.ID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	u.Login = anonymousLogin
+	u.Blocked = true
+	u.TOTPEnabled = false
+	u.totpSecret = ""
+	return rollbackErr
+}
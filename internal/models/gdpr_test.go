@@ -0,0 +1,51 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/kazauwa/gophermart/internal/storage/storagetest"
+)
+
+func TestIsReservedLogin(t *testing.T) {
+	tests := map[string]bool{
+		"gopher":     false,
+		"undeleted_": false,
+		"deleted_":   true,
+		"deleted_42": true,
+		"Deleted_42": true,
+	}
+	for login, want := range tests {
+		if got := IsReservedLogin(login); got != want {
+			t.Errorf("IsReservedLogin(%q) = %v, want %v", login, got, want)
+		}
+	}
+}
+
+func TestAnonymizeDoesNotCollideWithSquattedLogin(t *testing.T) {
+	storagetest.Require(t)
+	ctx := context.Background()
+
+	victim := newTestUser(t, "victim")
+	// Registration rejects reserved logins now, but accounts created before
+	// that may hold the login an erasure would have used.
+	squatter := newTestUser(t, fmt.Sprintf("%s%d", AnonymousLoginPrefix, victim.ID))
+
+	if err := victim.Anonymize(ctx); err != nil {
+		t.Fatalf("Anonymize: %v", err)
+	}
+
+	if !strings.HasPrefix(victim.Login, AnonymousLoginPrefix) || victim.Login == squatter.Login {
+		t.Errorf("got anonymous login %q next to squatter %q", victim.Login, squatter.Login)
+	}
+
+	stored := NewUser()
+	if err := stored.GetByID(ctx, victim.ID); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Login != victim.Login || !stored.Blocked {
+		t.Errorf("got stored user %q blocked=%v, want %q blocked", stored.Login, stored.Blocked, victim.Login)
+	}
+}
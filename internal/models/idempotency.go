@@ -0,0 +1,130 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/kazauwa/gophermart/internal/storage"
+)
+
+type IdempotencyKey struct {
+	UserID      int
+	Key         string
+	RequestHash string
+	StatusCode  *int
+	ContentType string
+	Response    []byte
+	CreatedAt   time.Time
+	// LockedUntil is the end of the processing lease of an incomplete key.
+	// Once it passes, a retry of the same request may take the key over.
+	LockedUntil time.Time
+}
+
+func NewIdempotencyKey(userID int, key string) *IdempotencyKey {
+	return &IdempotencyKey{
+		UserID:    userID,
+		Key:       key,
+		CreatedAt: time.Now(),
+	}
+}
+
+func (k *IdempotencyKey) IsCompleted() bool {
+	return k.StatusCode != nil
+}
+
+func (k *IdempotencyKey) Get(ctx context.Context, notBefore time.Time) error {
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	query := `SELECT request_hash, status_code, coalesce(content_type, ''), response, created_at
+		FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2 AND created_at >= $3`
+	err := db.Pool.QueryRow(ctx, query, k.UserID, k.Key, notBefore).Scan(
+		&k.RequestHash, &k.StatusCode, &k.ContentType, &k.Response, &k.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Reserve claims the key for an in-flight request. It returns false if the key
+// is already held by a live request or a stored response. A key whose request
+// never completed, e.g. because the process died, is taken over by the same
+// request once its lease has expired.
+func (k *IdempotencyKey) Reserve(ctx context.Context, notBefore time.Time) (bool, error) {
+	db := storage.GetDB()
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	var rollbackErr error
+	defer func() {
+		rollbackErr = tx.Rollback(ctx)
+	}()
+
+	deleteQuery := "DELETE FROM idempotency_keys WHERE created_at < $1"
+	if _, err = tx.Exec(ctx, deleteQuery, notBefore); err != nil {
+		return false, err
+	}
+
+	insertQuery := `INSERT INTO idempotency_keys (user_id, key, request_hash, created_at, locked_until)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, key) DO UPDATE
+		SET created_at = EXCLUDED.created_at, locked_until = EXCLUDED.locked_until
+		WHERE idempotency_keys.status_code IS NULL
+			AND idempotency_keys.request_hash = EXCLUDED.request_hash
+			AND (idempotency_keys.locked_until IS NULL OR idempotency_keys.locked_until < EXCLUDED.created_at)`
+	tag, err := tx.Exec(ctx, insertQuery, k.UserID, k.Key, k.RequestHash, k.CreatedAt, k.LockedUntil)
+	if err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, rollbackErr
+}
+
+func (k *IdempotencyKey) SaveResponse(
+	ctx context.Context,
+	statusCode int,
+	contentType string,
+	response []byte,
+) error {
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	updateQuery := `UPDATE idempotency_keys
+		SET status_code = $1, content_type = $2, response = $3
+		WHERE user_id = $4 AND key = $5`
+	_, err := db.Pool.Exec(ctx, updateQuery, statusCode, contentType, response, k.UserID, k.Key)
+	if err != nil {
+		return err
+	}
+
+	k.StatusCode = &statusCode
+	k.ContentType = contentType
+	k.Response = response
+	return nil
+}
+
+func (k *IdempotencyKey) Delete(ctx context.Context) error {
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	deleteQuery := "DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2"
+	if _, err := db.Pool.Exec(ctx, deleteQuery, k.UserID, k.Key); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"context"
+
+	"github.com/kazauwa/gophermart/internal/storage"
+)
+
+func (u *User) GetByIdentity(ctx context.Context, issuer, subject string) error {
+	query := selectUserQuery + ` WHERE id = (
+		SELECT user_id FROM user_identities WHERE issuer = $1 AND subject = $2
+	)`
+
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	return db.Pool.QueryRow(ctx, query, issuer, subject).Scan(u.scanDest()...)
+}
+
+func (u *User) LinkIdentity(ctx context.Context, issuer, subject string) error {
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	insertQuery := "INSERT INTO user_identities (issuer, subject, user_id) VALUES ($1, $2, $3)"
+	if _, err := db.Pool.Exec(ctx, insertQuery, issuer, subject, u.ID); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// InsertWithIdentity creates the user together with an external identity.
+func (u *User) InsertWithIdentity(ctx context.Context, issuer, subject string) error {
+	db := storage.GetDB()
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	var rollbackErr error
+	defer func() {
+		rollbackErr = tx.Rollback(ctx)
+	}()
+
+	insertQuery := "INSERT INTO users (login, password) VALUES ($1, $2) RETURNING id"
+	if err = tx.QueryRow(ctx, insertQuery, u.Login, u.password).Scan(&u.ID); err != nil {
+		return err
+	}
+
+	identityQuery := "INSERT INTO user_identities (issuer, subject, user_id) VALUES ($1, $2, $3)"
+	if _, err = tx.Exec(ctx, identityQuery, issuer, subject, u.ID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	return rollbackErr
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/alexedwards/argon2id"
+
+	"github.com/kazauwa/gophermart/internal/storage/storagetest"
+)
+
+// testArgon keeps password hashing cheap in tests.
+var testArgon = &argon2id.Params{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestMain(m *testing.M) {
+	os.Exit(storagetest.Run(m))
+}
+
+// newTestUser inserts a user with the given login.
+func newTestUser(t *testing.T, login string) *User {
+	t.Helper()
+
+	user := NewUser()
+	user.Login = login
+	if err := user.SetPassword("password", testArgon); err != nil {
+		t.Fatal(err)
+	}
+	if err := user.Insert(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
@@ -3,12 +3,13 @@ package models
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"time"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/shopspring/decimal"
 
 	"github.com/kazauwa/gophermart/internal/storage"
+	"github.com/kazauwa/gophermart/internal/utils"
 )
 
 type OrderStatus = string
@@ -20,12 +21,34 @@ const (
 	Processed  OrderStatus = "PROCESSED"
 )
 
+type UploadResult = string
+
+const (
+	UploadAccepted        UploadResult = "accepted"
+	UploadAlreadyUploaded UploadResult = "already_uploaded"
+	UploadConflict        UploadResult = "conflict"
+	UploadInvalid         UploadResult = "invalid"
+)
+
+type StatusSource = string
+
+const (
+	SourceUser     StatusSource = "user"
+	SourcePoller   StatusSource = "poller"
+	SourceCallback StatusSource = "callback"
+	SourceAdmin    StatusSource = "admin"
+	SourcePartner  StatusSource = "partner"
+	// SourceMigration marks history rows backfilled for orders uploaded
+	// before the status timeline existed.
+	SourceMigration StatusSource = "migration"
+)
+
 type Order struct {
-	ID         int64           `json:"number"`
-	UserID     int             `json:"-"`
-	Status     OrderStatus     `json:"status"`
-	Accrual    decimal.Decimal `json:"accrual,omitempty"`
-	UploadedAt time.Time       `json:"uploaded_at"`
+	ID         utils.OrderNumber `json:"number"`
+	UserID     int               `json:"-"`
+	Status     OrderStatus       `json:"status"`
+	Accrual    decimal.Decimal   `json:"accrual,omitempty"`
+	UploadedAt time.Time         `json:"uploaded_at"`
 }
 
 func NewOrder() *Order {
@@ -48,14 +71,14 @@ func (o *Order) MarshalJSON() ([]byte, error) {
 		UploadedAt string           `json:"uploaded_at"`
 		*shadowOrder
 	}{
-		ID:          fmt.Sprint(o.ID),
+		ID:          o.ID.String(),
 		UploadedAt:  o.UploadedAt.Format(time.RFC3339),
 		Accrual:     accrual,
 		shadowOrder: (*shadowOrder)(o),
 	})
 }
 
-func (o *Order) Insert(ctx context.Context) error {
+func (o *Order) Insert(ctx context.Context, source StatusSource) error {
 	db := storage.GetDB()
 	db.Lock.Lock()
 	defer db.Lock.Unlock()
@@ -76,26 +99,131 @@ func (o *Order) Insert(ctx context.Context) error {
 		return err
 	}
 
+	if err = insertStatusChange(ctx, tx, o.ID, o.Status, source); err != nil {
+		return err
+	}
+
 	if err := tx.Commit(ctx); err != nil {
 		return err
 	}
 	return rollbackErr
 }
 
-func (o *Order) SetFailed(ctx context.Context, orderID int64) error {
+func InsertOrders(
+	ctx context.Context,
+	userID int,
+	orderIDs []utils.OrderNumber,
+) (map[utils.OrderNumber]UploadResult, error) {
 	db := storage.GetDB()
-	db.Lock.RLock()
-	defer db.Lock.RUnlock()
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rollbackErr error
+	defer func() {
+		rollbackErr = tx.Rollback(ctx)
+	}()
+
+	lookup := make([]string, 0, len(orderIDs))
+	for _, orderID := range orderIDs {
+		lookup = append(lookup, orderID.String())
+	}
+
+	results := make(map[utils.OrderNumber]UploadResult, len(orderIDs))
+	rows, err := tx.Query(ctx, "SELECT id, user_id FROM orders WHERE id = ANY($1)", lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var orderID utils.OrderNumber
+		var ownerID int
+		if err = rows.Scan(&orderID, &ownerID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		if ownerID == userID {
+			results[orderID] = UploadAlreadyUploaded
+		} else {
+			results[orderID] = UploadConflict
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	insertQuery := "INSERT INTO orders (id, user_id) VALUES ($1, $2)"
+	for _, orderID := range orderIDs {
+		if _, ok := results[orderID]; ok {
+			continue
+		}
+
+		if _, err = tx.Exec(ctx, insertQuery, orderID, userID); err != nil {
+			return nil, err
+		}
+
+		if err = insertStatusChange(ctx, tx, orderID, New, SourceUser); err != nil {
+			return nil, err
+		}
+		results[orderID] = UploadAccepted
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return results, rollbackErr
+}
+
+func (o *Order) SetFailed(
+	ctx context.Context,
+	orderID utils.OrderNumber,
+	source StatusSource,
+) error {
+	return o.SetStatus(ctx, orderID, Invalid, source)
+}
 
-	orderUpdateQuery := `UPDATE orders SET status = 'FAILED' WHERE id = $1`
-	if _, err := db.Pool.Exec(ctx, orderUpdateQuery, orderID); err != nil {
+func (o *Order) SetStatus(
+	ctx context.Context,
+	orderID utils.OrderNumber,
+	status OrderStatus,
+	source StatusSource,
+) error {
+	db := storage.GetDB()
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	var rollbackErr error
+	defer func() {
+		rollbackErr = tx.Rollback(ctx)
+	}()
+
+	orderUpdateQuery := `UPDATE orders SET status = $1 WHERE id = $2`
+	if _, err := tx.Exec(ctx, orderUpdateQuery, status, orderID); err != nil {
+		return err
+	}
+
+	if err = insertStatusChange(ctx, tx, orderID, status, source); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	return rollbackErr
 }
 
-func (o *Order) GetByID(ctx context.Context, orderID int64) error {
+func (o *Order) GetByID(ctx context.Context, orderID utils.OrderNumber) error {
 	db := storage.GetDB()
 	db.Lock.RLock()
 	defer db.Lock.RUnlock()
@@ -152,3 +280,88 @@ func GetUnprocessedOrders(ctx context.Context) ([]*Order, error) {
 	}
 	return orders, nil
 }
+
+func (o *Order) GetStatusHistory(ctx context.Context) ([]*OrderStatusChange, error) {
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	history := make([]*OrderStatusChange, 0)
+	selectQuery := `SELECT status, source, changed_at
+		FROM order_status_history
+		WHERE order_id = $1
+		ORDER BY changed_at ASC, id ASC`
+	rows, err := db.Pool.Query(ctx, selectQuery, o.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		change := &OrderStatusChange{}
+		if err = rows.Scan(&change.Status, &change.Source, &change.ChangedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, change)
+	}
+	return history, nil
+}
+
+type OrderStatusChange struct {
+	Status    OrderStatus  `json:"status"`
+	Source    StatusSource `json:"source"`
+	ChangedAt time.Time    `json:"changed_at"`
+}
+
+func (c *OrderStatusChange) MarshalJSON() ([]byte, error) {
+	type shadowOrderStatusChange OrderStatusChange
+	return json.Marshal(&struct {
+		ChangedAt string `json:"changed_at"`
+		*shadowOrderStatusChange
+	}{
+		ChangedAt:               c.ChangedAt.Format(time.RFC3339),
+		shadowOrderStatusChange: (*shadowOrderStatusChange)(c),
+	})
+}
+
+func insertStatusChange(
+	ctx context.Context,
+	tx pgx.Tx,
+	orderID utils.OrderNumber,
+	status OrderStatus,
+	source StatusSource,
+) error {
+	insertQuery := `INSERT INTO order_status_history (order_id, status, source)
+		VALUES ($1, $2, $3)`
+	_, err := tx.Exec(ctx, insertQuery, orderID, status, source)
+	return err
+}
+
+type OrderDetails struct {
+	Order      *Order
+	History    []*OrderStatusChange
+	Withdrawal *Withdrawal
+}
+
+func (d *OrderDetails) MarshalJSON() ([]byte, error) {
+	var accrual *decimal.Decimal
+	if !d.Order.Accrual.IsZero() {
+		accrual = &d.Order.Accrual
+	}
+
+	return json.Marshal(&struct {
+		ID         string               `json:"number"`
+		Status     OrderStatus          `json:"status"`
+		Accrual    *decimal.Decimal     `json:"accrual,omitempty"`
+		UploadedAt string               `json:"uploaded_at"`
+		History    []*OrderStatusChange `json:"history"`
+		Withdrawal *Withdrawal          `json:"withdrawal,omitempty"`
+	}{
+		ID:         d.Order.ID.String(),
+		Status:     d.Order.Status,
+		Accrual:    accrual,
+		UploadedAt: d.Order.UploadedAt.Format(time.RFC3339),
+		History:    d.History,
+		Withdrawal: d.Withdrawal,
+	})
+}
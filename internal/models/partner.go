@@ -0,0 +1,360 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/kazauwa/gophermart/internal/storage"
+)
+
+type APIKeyScope = string
+
+const (
+	ScopeOrdersWrite    APIKeyScope = "orders:write"
+	ScopeCustomersWrite APIKeyScope = "customers:write"
+)
+
+const apiKeyPrefix = "gm"
+
+var (
+	ErrInvalidAPIKey    = errors.New("invalid api key")
+	ErrInvalidLinkToken = errors.New("invalid partner link token")
+	ErrCustomerLinked   = errors.New("customer is linked to another user")
+)
+
+func IsValidScope(scope string) bool {
+	switch scope {
+	case ScopeOrdersWrite, ScopeCustomersWrite:
+		return true
+	}
+	return false
+}
+
+type Partner struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func NewPartner(name string) *Partner {
+	return &Partner{Name: name}
+}
+
+func (p *Partner) MarshalJSON() ([]byte, error) {
+	type shadowPartner Partner
+	return json.Marshal(&struct {
+		CreatedAt string `json:"created_at"`
+		*shadowPartner
+	}{
+		CreatedAt:     p.CreatedAt.Format(time.RFC3339),
+		shadowPartner: (*shadowPartner)(p),
+	})
+}
+
+func (p *Partner) Insert(ctx context.Context) error {
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	insertQuery := "INSERT INTO partners (name) VALUES ($1) RETURNING id, created_at"
+	return db.Pool.QueryRow(ctx, insertQuery, p.Name).Scan(&p.ID, &p.CreatedAt)
+}
+
+func (p *Partner) GetByID(ctx context.Context, partnerID int) error {
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	query := "SELECT id, name, created_at FROM partners WHERE id = $1"
+	return db.Pool.QueryRow(ctx, query, partnerID).Scan(&p.ID, &p.Name, &p.CreatedAt)
+}
+
+type APIKey struct {
+	ID         int           `json:"id"`
+	PartnerID  int           `json:"partner_id"`
+	Prefix     string        `json:"prefix"`
+	Scopes     []APIKeyScope `json:"scopes"`
+	CreatedAt  time.Time     `json:"created_at"`
+	LastUsedAt *time.Time    `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time    `json:"revoked_at,omitempty"`
+	keyHash    string
+}
+
+func (k *APIKey) HasScope(scope APIKeyScope) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *APIKey) MarshalJSON() ([]byte, error) {
+	formatTime := func(t *time.Time) *string {
+		if t == nil {
+			return nil
+		}
+		formatted := t.Format(time.RFC3339)
+		return &formatted
+	}
+
+	type shadowAPIKey APIKey
+	return json.Marshal(&struct {
+		CreatedAt  string  `json:"created_at"`
+		LastUsedAt *string `json:"last_used_at,omitempty"`
+		RevokedAt  *string `json:"revoked_at,omitempty"`
+		*shadowAPIKey
+	}{
+		CreatedAt:    k.CreatedAt.Format(time.RFC3339),
+		LastUsedAt:   formatTime(k.LastUsedAt),
+		RevokedAt:    formatTime(k.RevokedAt),
+		shadowAPIKey: (*shadowAPIKey)(k),
+	})
+}
+
+// IssueAPIKey creates a key for the partner and returns it in plain text. Only
+// its hash is stored, so the caller must hand the key over right away.
+func (p *Partner) IssueAPIKey(ctx context.Context, scopes []APIKeyScope) (*APIKey, string, error) {
+	prefixBytes := make([]byte, 6)
+	if _, err := rand.Read(prefixBytes); err != nil {
+		return nil, "", err
+	}
+
+	secret, err := newOpaqueToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	key := &APIKey{
+		PartnerID: p.ID,
+		Prefix:    hex.EncodeToString(prefixBytes),
+		Scopes:    scopes,
+		keyHash:   hashToken(secret),
+	}
+
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	insertQuery := `INSERT INTO partner_api_keys (partner_id, prefix, key_hash, scopes)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`
+	err = db.Pool.QueryRow(ctx, insertQuery, key.PartnerID, key.Prefix, key.keyHash, key.Scopes).Scan(
+		&key.ID, &key.CreatedAt,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return key, strings.Join([]string{apiKeyPrefix, key.Prefix, secret}, "_"), nil
+}
+
+func (p *Partner) GetAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	keys := make([]*APIKey, 0)
+	query := `SELECT id, partner_id, prefix, scopes, created_at, last_used_at, revoked_at
+		FROM partner_api_keys
+		WHERE partner_id = $1
+		ORDER BY created_at`
+	rows, err := db.Pool.Query(ctx, query, p.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		k := &APIKey{}
+		err = rows.Scan(&k.ID, &k.PartnerID, &k.Prefix, &k.Scopes, &k.CreatedAt, &k.LastUsedAt, &k.RevokedAt)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (p *Partner) RevokeAPIKey(ctx context.Context, keyID int) (bool, error) {
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	updateQuery := `UPDATE partner_api_keys SET revoked_at = $1
+		WHERE id = $2 AND partner_id = $3 AND revoked_at IS NULL`
+	tag, err := db.Pool.Exec(ctx, updateQuery, time.Now(), keyID, p.ID)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// Authenticate resolves a plain-text key to an active API key and records its
+// use.
+func (k *APIKey) Authenticate(ctx context.Context, rawKey string) error {
+	parts := strings.SplitN(rawKey, "_", 3)
+	if len(parts) != 3 || parts[0] != apiKeyPrefix {
+		return ErrInvalidAPIKey
+	}
+
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	query := `SELECT id, partner_id, prefix, key_hash, scopes, created_at, last_used_at
+		FROM partner_api_keys
+		WHERE prefix = $1 AND revoked_at IS NULL`
+	err := db.Pool.QueryRow(ctx, query, parts[1]).Scan(
+		&k.ID, &k.PartnerID, &k.Prefix, &k.keyHash, &k.Scopes, &k.CreatedAt, &k.LastUsedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(k.keyHash), []byte(hashToken(parts[2]))) != 1 {
+		return ErrInvalidAPIKey
+	}
+
+	now := time.Now()
+	updateQuery := "UPDATE partner_api_keys SET last_used_at = $1 WHERE id = $2"
+	if _, err := db.Pool.Exec(ctx, updateQuery, now, k.ID); err != nil {
+		return err
+	}
+
+	k.LastUsedAt = &now
+	return nil
+}
+
+// IssuePartnerLinkToken creates a one-time token with which the user consents
+// to being linked to a customer of the partner. Earlier unused tokens for the
+// same partner are invalidated.
+func (u *User) IssuePartnerLinkToken(ctx context.Context, partnerID int, ttl time.Duration) (string, error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	db := storage.GetDB()
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var rollbackErr error
+	defer func() {
+		rollbackErr = tx.Rollback(ctx)
+	}()
+
+	now := time.Now()
+	invalidateQuery := `UPDATE partner_link_tokens SET used_at = $1
+		WHERE user_id = $2 AND partner_id = $3 AND used_at IS NULL`
+	if _, err = tx.Exec(ctx, invalidateQuery, now, u.ID, partnerID); err != nil {
+		return "", err
+	}
+
+	insertQuery := `INSERT INTO partner_link_tokens (partner_id, user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4)`
+	if _, err = tx.Exec(ctx, insertQuery, partnerID, u.ID, hashToken(token), now.Add(ttl)); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", err
+	}
+	return token, rollbackErr
+}
+
+// LinkCustomer consumes a link token the user issued for this partner and
+// binds externalID to that user. Tokens of blocked or deleted users are
+// rejected, as are customer ids already linked to another user. It returns the
+// id of the linked user.
+func (p *Partner) LinkCustomer(ctx context.Context, externalID, linkToken string) (int, error) {
+	db := storage.GetDB()
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var rollbackErr error
+	defer func() {
+		rollbackErr = tx.Rollback(ctx)
+	}()
+
+	now := time.Now()
+	var userID int
+	consumeQuery := `UPDATE partner_link_tokens t SET used_at = $1
+		FROM users u
+		WHERE u.id = t.user_id AND u.blocked_at IS NULL
+			AND t.token_hash = $2 AND t.partner_id = $3
+			AND t.used_at IS NULL AND t.expires_at > $1
+		RETURNING t.user_id`
+	err = tx.QueryRow(ctx, consumeQuery, now, hashToken(linkToken), p.ID).Scan(&userID)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return 0, ErrInvalidLinkToken
+
+	case err != nil:
+		return 0, err
+	}
+
+	insertQuery := `INSERT INTO partner_customers (partner_id, external_id, user_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (partner_id, external_id) DO NOTHING`
+	tag, err := tx.Exec(ctx, insertQuery, p.ID, externalID, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	// An existing link is never moved to another user. Returning early rolls
+	// back the transaction, so the token stays usable.
+	if tag.RowsAffected() == 0 {
+		var linkedUserID int
+		linkedQuery := "SELECT user_id FROM partner_customers WHERE partner_id = $1 AND external_id = $2"
+		if err = tx.QueryRow(ctx, linkedQuery, p.ID, externalID).Scan(&linkedUserID); err != nil {
+			return 0, err
+		}
+		if linkedUserID != userID {
+			return 0, ErrCustomerLinked
+		}
+	}
+
+	event := NewAuditEvent(AuditCustomerLinked, 0, userID)
+	event.Details["partner_id"] = p.ID
+	event.Details["customer_id"] = externalID
+	if err = event.insert(ctx, tx); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return userID, rollbackErr
+}
+
+func (u *User) GetByPartnerCustomer(ctx context.Context, partnerID int, externalID string) error {
+	query := selectUserQuery + ` WHERE id = (
+		SELECT user_id FROM partner_customers WHERE partner_id = $1 AND external_id = $2
+	)`
+
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	return db.Pool.QueryRow(ctx, query, partnerID, externalID).Scan(u.scanDest()...)
+}
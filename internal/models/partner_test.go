@@ -0,0 +1,56 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kazauwa/gophermart/internal/storage/storagetest"
+)
+
+func TestLinkCustomerDoesNotMoveLinkedCustomer(t *testing.T) {
+	storagetest.Require(t)
+	ctx := context.Background()
+
+	partner := NewPartner("partner")
+	if err := partner.Insert(ctx); err != nil {
+		t.Fatal(err)
+	}
+	owner := newTestUser(t, "link_owner")
+	intruder := newTestUser(t, "link_intruder")
+
+	link := func(user *User) (string, int, error) {
+		token, err := user.IssuePartnerLinkToken(ctx, partner.ID, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		userID, err := partner.LinkCustomer(ctx, "customer-1", token)
+		return token, userID, err
+	}
+
+	if _, userID, err := link(owner); err != nil || userID != owner.ID {
+		t.Fatalf("first link: got user %d, err %v", userID, err)
+	}
+	if _, userID, err := link(owner); err != nil || userID != owner.ID {
+		t.Fatalf("repeated link by the owner: got user %d, err %v", userID, err)
+	}
+
+	token, _, err := link(intruder)
+	if !errors.Is(err, ErrCustomerLinked) {
+		t.Fatalf("got %v, want %v", err, ErrCustomerLinked)
+	}
+
+	linked := NewUser()
+	if err := linked.GetByPartnerCustomer(ctx, partner.ID, "customer-1"); err != nil {
+		t.Fatal(err)
+	}
+	if linked.ID != owner.ID {
+		t.Errorf("customer moved to user %d, want %d", linked.ID, owner.ID)
+	}
+
+	// The rejected token was not consumed.
+	if userID, err := partner.LinkCustomer(ctx, "customer-2", token); err != nil || userID != intruder.ID {
+		t.Errorf("reusing the rejected token: got user %d, err %v", userID, err)
+	}
+}
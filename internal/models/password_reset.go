@@ -0,0 +1,114 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/alexedwards/argon2id"
+	"github.com/jackc/pgx/v4"
+
+	"github.com/kazauwa/gophermart/internal/storage"
+)
+
+var ErrInvalidResetToken = errors.New("invalid password reset token")
+
+func (u *User) IssuePasswordResetToken(ctx context.Context, ttl time.Duration) (string, error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	db := storage.GetDB()
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var rollbackErr error
+	defer func() {
+		rollbackErr = tx.Rollback(ctx)
+	}()
+
+	now := time.Now()
+	invalidateQuery := `UPDATE password_reset_tokens SET used_at = $1
+		WHERE user_id = $2 AND used_at IS NULL`
+	if _, err = tx.Exec(ctx, invalidateQuery, now, u.ID); err != nil {
+		return "", err
+	}
+
+	insertQuery := `INSERT INTO password_reset_tokens (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3)`
+	if _, err = tx.Exec(ctx, insertQuery, u.ID, hashToken(token), now.Add(ttl)); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", err
+	}
+	return token, rollbackErr
+}
+
+// ResetPassword consumes a reset token, sets the new password and revokes all
+// sessions and refresh tokens of the token owner. The password is hashed only
+// after the token has been consumed, so invalid tokens cost no hashing.
+func ResetPassword(ctx context.Context, token, password string, params *argon2id.Params) error {
+	user := NewUser()
+	db := storage.GetDB()
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	var rollbackErr error
+	defer func() {
+		rollbackErr = tx.Rollback(ctx)
+	}()
+
+	now := time.Now()
+	consumeQuery := `UPDATE password_reset_tokens SET used_at = $1
+		WHERE token_hash = $2 AND used_at IS NULL AND expires_at > $1
+		RETURNING user_id`
+	err = tx.QueryRow(ctx, consumeQuery, now, hashToken(token)).Scan(&user.ID)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return ErrInvalidResetToken
+
+	case err != nil:
+		return err
+	}
+
+	if err = user.SetPassword(password, params); err != nil {
+		return err
+	}
+
+	updateQuery := "UPDATE users SET password = $1 WHERE id = $2"
+	if _, err = tx.Exec(ctx, updateQuery, user.password, user.ID); err != nil {
+		return err
+	}
+
+	sessionsQuery := "UPDATE user_sessions SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL"
+	if _, err = tx.Exec(ctx, sessionsQuery, now, user.ID); err != nil {
+		return err
+	}
+
+	tokensQuery := "UPDATE refresh_tokens SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL"
+	if _, err = tx.Exec(ctx, tokensQuery, now, user.ID); err != nil {
+		return err
+	}
+
+	if err = NewAuditEvent(AuditPasswordReset, user.ID, user.ID).insert(ctx, tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	return rollbackErr
+}
@@ -0,0 +1,129 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/kazauwa/gophermart/internal/storage"
+)
+
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+func newOpaqueToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func insertRefreshToken(ctx context.Context, tx pgx.Tx, userID int, ttl time.Duration) (string, error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	insertQuery := `INSERT INTO refresh_tokens (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3)`
+	_, err = tx.Exec(ctx, insertQuery, userID, hashToken(token), time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func IssueRefreshToken(ctx context.Context, userID int, ttl time.Duration) (string, error) {
+	db := storage.GetDB()
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var rollbackErr error
+	defer func() {
+		rollbackErr = tx.Rollback(ctx)
+	}()
+
+	token, err := insertRefreshToken(ctx, tx, userID, ttl)
+	if err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", err
+	}
+	return token, rollbackErr
+}
+
+// RotateRefreshToken revokes the presented token and issues a replacement for
+// the same user.
+func RotateRefreshToken(ctx context.Context, token string, ttl time.Duration) (int, string, error) {
+	db := storage.GetDB()
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return 0, "", err
+	}
+
+	var rollbackErr error
+	defer func() {
+		rollbackErr = tx.Rollback(ctx)
+	}()
+
+	var userID int
+	revokeQuery := `UPDATE refresh_tokens SET revoked_at = $1
+		WHERE token_hash = $2 AND revoked_at IS NULL AND expires_at > $1
+		RETURNING user_id`
+	err = tx.QueryRow(ctx, revokeQuery, time.Now(), hashToken(token)).Scan(&userID)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return 0, "", ErrInvalidRefreshToken
+
+	case err != nil:
+		return 0, "", err
+	}
+
+	newToken, err := insertRefreshToken(ctx, tx, userID, ttl)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, "", err
+	}
+	return userID, newToken, rollbackErr
+}
+
+// RevokeRefreshToken revokes a live refresh token of the user. Rotation
+// revokes every predecessor, so this ends the whole token chain.
+func RevokeRefreshToken(ctx context.Context, userID int, token string) (bool, error) {
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	query := `UPDATE refresh_tokens SET revoked_at = $1
+		WHERE token_hash = $2 AND user_id = $3 AND revoked_at IS NULL AND expires_at > $1`
+	tag, err := db.Pool.Exec(ctx, query, time.Now(), hashToken(token), userID)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
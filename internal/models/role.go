@@ -0,0 +1,63 @@
+package models
+
+type Role = string
+
+const (
+	RoleUser    Role = "user"
+	RoleSupport Role = "support"
+	RoleAdmin   Role = "admin"
+)
+
+// roleRanks orders the roles from least to most privileged.
+var roleRanks = map[Role]int{
+	RoleUser:    1,
+	RoleSupport: 2,
+	RoleAdmin:   3,
+}
+
+type Permission = string
+
+const (
+	PermissionViewUsers     Permission = "users:view"
+	PermissionBlockUsers    Permission = "users:block"
+	PermissionAdjustBalance Permission = "balance:adjust"
+	PermissionViewAudit     Permission = "audit:view"
+	PermissionManagePartner Permission = "partners:manage"
+)
+
+// Policy lists the roles allowed to exercise each permission. A permission
+// missing from the table is denied to everyone.
+var Policy = map[Permission][]Role{
+	PermissionViewUsers:     {RoleSupport, RoleAdmin},
+	PermissionBlockUsers:    {RoleSupport, RoleAdmin},
+	PermissionAdjustBalance: {RoleAdmin},
+	PermissionViewAudit:     {RoleAdmin},
+	PermissionManagePartner: {RoleAdmin},
+}
+
+func IsValidRole(role string) bool {
+	switch role {
+	case RoleUser, RoleSupport, RoleAdmin:
+		return true
+	}
+	return false
+}
+
+func (u *User) HasRole(roles ...Role) bool {
+	for _, role := range roles {
+		if u.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) Can(permission Permission) bool {
+	return u.HasRole(Policy[permission]...)
+}
+
+// Outranks reports whether the user's role is strictly above the other user's.
+// Unknown roles rank below every known one.
+func (u *User) Outranks(other *User) bool {
+	return roleRanks[u.Role] > roleRanks[other.Role]
+}
@@ -0,0 +1,27 @@
+package models
+
+import "testing"
+
+func TestOutranks(t *testing.T) {
+	tests := []struct {
+		user, other Role
+		want        bool
+	}{
+		{RoleAdmin, RoleSupport, true},
+		{RoleAdmin, RoleUser, true},
+		{RoleSupport, RoleUser, true},
+		{RoleSupport, RoleAdmin, false},
+		{RoleSupport, RoleSupport, false},
+		{RoleAdmin, RoleAdmin, false},
+		{RoleUser, RoleSupport, false},
+		{RoleUser, "unknown", true},
+		{"unknown", RoleUser, false},
+	}
+
+	for _, tt := range tests {
+		user, other := &User{Role: tt.user}, &User{Role: tt.other}
+		if got := user.Outranks(other); got != tt.want {
+			t.Errorf("%s outranks %s: got %v, want %v", tt.user, tt.other, got, tt.want)
+		}
+	}
+}
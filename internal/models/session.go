@@ -0,0 +1,191 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/kazauwa/gophermart/internal/storage"
+)
+
+type Session struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+	token      string
+}
+
+func NewSession(userID int, userAgent, ip string) *Session {
+	return &Session{
+		UserID:    userID,
+		UserAgent: userAgent,
+		IP:        ip,
+	}
+}
+
+func (s *Session) MarshalJSON() ([]byte, error) {
+	type shadowSession Session
+	return json.Marshal(&struct {
+		CreatedAt  string `json:"created_at"`
+		LastSeenAt string `json:"last_seen_at"`
+		ExpiresAt  string `json:"expires_at"`
+		*shadowSession
+	}{
+		CreatedAt:     s.CreatedAt.Format(time.RFC3339),
+		LastSeenAt:    s.LastSeenAt.Format(time.RFC3339),
+		ExpiresAt:     s.ExpiresAt.Format(time.RFC3339),
+		shadowSession: (*shadowSession)(s),
+	})
+}
+
+func (s *Session) Token() string {
+	return s.token
+}
+
+// Insert stores the session. It expires ttl after creation regardless of
+// activity.
+func (s *Session) Insert(ctx context.Context, ttl time.Duration) error {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	db := storage.GetDB()
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	var rollbackErr error
+	defer func() {
+		rollbackErr = tx.Rollback(ctx)
+	}()
+
+	insertQuery := `INSERT INTO user_sessions (user_id, token_hash, user_agent, ip, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, last_seen_at, expires_at`
+	err = tx.QueryRow(ctx, insertQuery, s.UserID, hashToken(token), s.UserAgent, s.IP, time.Now().Add(ttl)).Scan(
+		&s.ID, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	s.token = token
+	return rollbackErr
+}
+
+// GetActiveByToken loads a non-revoked, unexpired session and bumps its last
+// seen time. Sessions created before expiry was tracked have no expires_at and
+// are treated as expired.
+func (s *Session) GetActiveByToken(ctx context.Context, token string) error {
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	query := `UPDATE user_sessions SET last_seen_at = $1
+		WHERE token_hash = $2 AND revoked_at IS NULL AND expires_at > $1
+		RETURNING id, user_id, coalesce(user_agent, ''), coalesce(ip, ''), created_at, last_seen_at, expires_at`
+	err := db.Pool.QueryRow(ctx, query, time.Now(), hashToken(token)).Scan(
+		&s.ID, &s.UserID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	s.token = token
+	return nil
+}
+
+func (s *Session) Revoke(ctx context.Context) error {
+	_, err := RevokeSession(ctx, s.UserID, s.ID)
+	return err
+}
+
+func RevokeSession(ctx context.Context, userID, sessionID int) (bool, error) {
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	query := `UPDATE user_sessions SET revoked_at = $1
+		WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL`
+	tag, err := db.Pool.Exec(ctx, query, time.Now(), sessionID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// RevokeUserSessions revokes every session of the user except keepSessionID
+// along with their refresh tokens. Pass zero to revoke all sessions.
+func RevokeUserSessions(ctx context.Context, userID, keepSessionID int) error {
+	db := storage.GetDB()
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	var rollbackErr error
+	defer func() {
+		rollbackErr = tx.Rollback(ctx)
+	}()
+
+	now := time.Now()
+	sessionsQuery := `UPDATE user_sessions SET revoked_at = $1
+		WHERE user_id = $2 AND id <> $3 AND revoked_at IS NULL`
+	if _, err = tx.Exec(ctx, sessionsQuery, now, userID, keepSessionID); err != nil {
+		return err
+	}
+
+	tokensQuery := "UPDATE refresh_tokens SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL"
+	if _, err = tx.Exec(ctx, tokensQuery, now, userID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	return rollbackErr
+}
+
+func (u *User) GetActiveSessions(ctx context.Context) ([]*Session, error) {
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	sessions := make([]*Session, 0)
+	query := `SELECT id, user_id, coalesce(user_agent, ''), coalesce(ip, ''), created_at, last_seen_at, expires_at
+		FROM user_sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2
+		ORDER BY last_seen_at DESC`
+	rows, err := db.Pool.Query(ctx, query, u.ID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		s := &Session{}
+		err = rows.Scan(&s.ID, &s.UserID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
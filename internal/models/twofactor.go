@@ -0,0 +1,280 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+
+	"github.com/kazauwa/gophermart/internal/storage"
+)
+
+const (
+	totpPeriod        = 30
+	totpSkew          = 1
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrTwoFactorAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotSetUp       = errors.New("two-factor authentication is not set up")
+)
+
+var totpOpts = totp.ValidateOpts{
+	Period:    totpPeriod,
+	Digits:    otp.DigitsSix,
+	Algorithm: otp.AlgorithmSHA1,
+}
+
+func newRecoveryCode() (string, error) {
+	buf := make([]byte, 5)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(buf))
+	return code[:4] + "-" + code[4:], nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// SetupTOTP generates a pending TOTP secret and a fresh set of recovery codes.
+// The secret takes effect only after EnableTOTP verifies the first code.
+func (u *User) SetupTOTP(ctx context.Context, issuer string) (string, []string, error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      issuer,
+		AccountName: u.Login,
+		Period:      totpPeriod,
+		Digits:      totpOpts.Digits,
+		Algorithm:   totpOpts.Algorithm,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	recoveryCodes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return "", nil, err
+		}
+		recoveryCodes = append(recoveryCodes, code)
+	}
+
+	db := storage.GetDB()
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var rollbackErr error
+	defer func() {
+		rollbackErr = tx.Rollback(ctx)
+	}()
+
+	updateQuery := `UPDATE users SET totp_secret = $1, totp_enabled = false, totp_last_step = 0
+		WHERE id = $2 AND NOT coalesce(totp_enabled, false)`
+	tag, err := tx.Exec(ctx, updateQuery, key.Secret(), u.ID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return "", nil, ErrTwoFactorAlreadyEnabled
+	}
+
+	if _, err = tx.Exec(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", u.ID); err != nil {
+		return "", nil, err
+	}
+
+	insertQuery := "INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)"
+	for _, code := range recoveryCodes {
+		if _, err = tx.Exec(ctx, insertQuery, u.ID, hashToken(normalizeRecoveryCode(code))); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", nil, err
+	}
+
+	u.totpSecret = key.Secret()
+	u.TOTPEnabled = false
+	return key.URL(), recoveryCodes, rollbackErr
+}
+
+func (u *User) EnableTOTP(ctx context.Context, code string) (bool, error) {
+	if u.TOTPEnabled {
+		return false, ErrTwoFactorAlreadyEnabled
+	}
+
+	if u.totpSecret == "" {
+		return false, ErrTwoFactorNotSetUp
+	}
+
+	ok, err := u.VerifyTOTP(ctx, code)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	updateQuery := "UPDATE users SET totp_enabled = true WHERE id = $1"
+	if _, err := db.Pool.Exec(ctx, updateQuery, u.ID); err != nil {
+		return false, err
+	}
+
+	u.TOTPEnabled = true
+	return true, nil
+}
+
+// VerifyTOTP checks the code against the current time window and rejects codes
+// from a time step that has already been used.
+func (u *User) VerifyTOTP(ctx context.Context, code string) (bool, error) {
+	if u.totpSecret == "" {
+		return false, ErrTwoFactorNotSetUp
+	}
+
+	now := time.Now()
+	for offset := -totpSkew; offset <= totpSkew; offset++ {
+		stepTime := now.Add(time.Duration(offset*totpPeriod) * time.Second)
+		expected, err := totp.GenerateCodeCustom(u.totpSecret, stepTime, totpOpts)
+		if err != nil {
+			return false, err
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) != 1 {
+			continue
+		}
+
+		db := storage.GetDB()
+		db.Lock.RLock()
+		defer db.Lock.RUnlock()
+
+		updateQuery := "UPDATE users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1"
+		tag, err := db.Pool.Exec(ctx, updateQuery, stepTime.Unix()/totpPeriod, u.ID)
+		if err != nil {
+			return false, err
+		}
+		return tag.RowsAffected() == 1, nil
+	}
+	return false, nil
+}
+
+func (u *User) ConsumeRecoveryCode(ctx context.Context, code string) (bool, error) {
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	updateQuery := `UPDATE recovery_codes SET used_at = $1
+		WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL`
+	tag, err := db.Pool.Exec(ctx, updateQuery, time.Now(), u.ID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+type LoginChallenge struct {
+	ID          int
+	UserID      int
+	IssueTokens bool
+	Attempts    int
+	// PasswordRehash is a stronger hash of the password computed at the
+	// password step. It is saved only once the second factor is verified.
+	PasswordRehash string
+}
+
+func NewLoginChallenge(userID int, issueTokens bool) *LoginChallenge {
+	return &LoginChallenge{
+		UserID:      userID,
+		IssueTokens: issueTokens,
+	}
+}
+
+func (ch *LoginChallenge) Insert(ctx context.Context, ttl time.Duration) (string, error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	insertQuery := `INSERT INTO login_challenges (user_id, token_hash, issue_tokens, expires_at, password_rehash)
+		VALUES ($1, $2, $3, $4, nullif($5, ''))
+		RETURNING id`
+	err = db.Pool.QueryRow(
+		ctx, insertQuery, ch.UserID, hashToken(token), ch.IssueTokens, time.Now().Add(ttl), ch.PasswordRehash,
+	).Scan(&ch.ID)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func (ch *LoginChallenge) GetActiveByToken(ctx context.Context, token string) error {
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	query := `SELECT id, user_id, issue_tokens, attempts, coalesce(password_rehash, '')
+		FROM login_challenges
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2`
+	err := db.Pool.QueryRow(ctx, query, hashToken(token), time.Now()).Scan(
+		&ch.ID, &ch.UserID, &ch.IssueTokens, &ch.Attempts, &ch.PasswordRehash,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (ch *LoginChallenge) Complete(ctx context.Context) (bool, error) {
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	updateQuery := "UPDATE login_challenges SET used_at = $1 WHERE id = $2 AND used_at IS NULL"
+	tag, err := db.Pool.Exec(ctx, updateQuery, time.Now(), ch.ID)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// RecordFailure counts a wrong code and burns the challenge once maxAttempts
+// is reached.
+func (ch *LoginChallenge) RecordFailure(ctx context.Context, maxAttempts int) error {
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	updateQuery := `UPDATE login_challenges
+		SET attempts = attempts + 1,
+			used_at = CASE WHEN attempts + 1 >= $1 THEN $2 ELSE NULL END
+		WHERE id = $3`
+	if _, err := db.Pool.Exec(ctx, updateQuery, maxAttempts, time.Now(), ch.ID); err != nil {
+		return err
+	}
+
+	ch.Attempts++
+	return nil
+}
@@ -7,27 +7,34 @@ import (
 	"time"
 
 	"github.com/alexedwards/argon2id"
+	"github.com/jackc/pgx/v4"
 	"github.com/shopspring/decimal"
 
 	"github.com/kazauwa/gophermart/internal/storage"
+	"github.com/kazauwa/gophermart/internal/utils"
 )
 
 var ErrInsufficientBalance = errors.New("insufficient balance")
 
 type User struct {
-	ID       int             `json:"-"`
-	Balance  decimal.Decimal `json:"balance"`
-	Login    string          `json:"login"`
-	password string
+	ID          int             `json:"-"`
+	Balance     decimal.Decimal `json:"balance"`
+	Login       string          `json:"login"`
+	TOTPEnabled bool            `json:"-"`
+	Role        Role            `json:"role"`
+	Blocked     bool            `json:"blocked"`
+	password    string
+	totpSecret  string
 }
 
 func NewUser() *User {
-	return &User{}
+	return &User{
+		Role: RoleUser,
+	}
 }
 
-func (u *User) SetPassword(password string) error {
-	// TODO: прокидывать параметры из конфига
-	passwordHash, err := argon2id.CreateHash(password, argon2id.DefaultParams)
+func (u *User) SetPassword(password string, params *argon2id.Params) error {
+	passwordHash, err := argon2id.CreateHash(password, params)
 	if err != nil {
 		return err
 	}
@@ -39,28 +46,58 @@ func (u *User) CheckPassword(password string) (bool, error) {
 	return argon2id.ComparePasswordAndHash(password, u.password)
 }
 
-func (u *User) withdraw(sum decimal.Decimal) error {
-	if sum.IsNegative() || sum.IsZero() {
-		return fmt.Errorf("incorrect withdrawal amount")
+func (u *User) NeedsRehash(params *argon2id.Params) (bool, error) {
+	current, salt, key, err := argon2id.DecodeHash(u.password)
+	if err != nil {
+		return false, err
 	}
 
-	if sum.GreaterThan(u.Balance) {
-		return ErrInsufficientBalance
+	return current.Memory < params.Memory ||
+		current.Iterations < params.Iterations ||
+		current.Parallelism < params.Parallelism ||
+		uint32(len(salt)) < params.SaltLength ||
+		uint32(len(key)) < params.KeyLength, nil
+}
+
+// RehashPassword returns a hash of password under params if the stored hash
+// is weaker, or an empty string if it is up to date. The stored hash is not
+// changed; see SetPasswordHash.
+func (u *User) RehashPassword(password string, params *argon2id.Params) (string, error) {
+	needsRehash, err := u.NeedsRehash(params)
+	if err != nil || !needsRehash {
+		return "", err
 	}
-	u.Balance = u.Balance.Sub(sum)
+	return argon2id.CreateHash(password, params)
+}
 
-	return nil
+func (u *User) SetPasswordHash(passwordHash string) {
+	u.password = passwordHash
 }
 
-func (u *User) Withdraw(ctx context.Context, orderID int64, sum decimal.Decimal) error {
+func (u *User) UpdatePassword(ctx context.Context) error {
 	db := storage.GetDB()
-	db.Lock.Lock()
-	defer db.Lock.Unlock()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
 
-	if err := u.withdraw(sum); err != nil {
+	updateQuery := "UPDATE users SET password = $1 WHERE id = $2"
+	if _, err := db.Pool.Exec(ctx, updateQuery, u.password, u.ID); err != nil {
 		return err
 	}
 
+	return nil
+}
+
+// Withdraw debits sum from the balance. The balance is updated relative to
+// its stored value, so concurrent writers cannot overwrite each other.
+func (u *User) Withdraw(ctx context.Context, orderID utils.OrderNumber, sum decimal.Decimal) error {
+	if sum.IsNegative() || sum.IsZero() {
+		return fmt.Errorf("incorrect withdrawal amount")
+	}
+
+	db := storage.GetDB()
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
 	tx, err := db.Pool.Begin(ctx)
 	if err != nil {
 		return err
@@ -81,36 +118,51 @@ func (u *User) Withdraw(ctx context.Context, orderID int64, sum decimal.Decimal)
 		return err
 	}
 
-	updateQuery := "UPDATE users SET balance = $1 WHERE id = $2"
-	if _, err = tx.Exec(ctx, updateQuery, u.Balance, u.ID); err != nil {
+	var balance decimal.Decimal
+	updateQuery := `UPDATE users SET balance = balance - $1
+		WHERE id = $2 AND balance >= $1
+		RETURNING balance`
+	err = tx.QueryRow(ctx, updateQuery, sum, u.ID).Scan(&balance)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return ErrInsufficientBalance
+
+	case err != nil:
+		return err
+	}
+
+	event := NewAuditEvent(AuditWithdrawal, u.ID, u.ID)
+	event.Details["order"] = orderID.String()
+	event.Details["sum"] = sum.String()
+	event.Details["balance"] = balance.String()
+	if err = event.insert(ctx, tx); err != nil {
 		return err
 	}
 
 	if err := tx.Commit(ctx); err != nil {
 		return err
 	}
+
+	u.Balance = balance
 	return rollbackErr
 }
 
-func (u *User) deposit(sum decimal.Decimal) error {
-	if sum.IsNegative() || sum.IsZero() {
+// Deposit credits the accrual for a processed order. Like Withdraw, it
+// updates the balance relative to its stored value.
+func (u *User) Deposit(
+	ctx context.Context,
+	orderID utils.OrderNumber,
+	accrual decimal.Decimal,
+	source StatusSource,
+) error {
+	if accrual.IsNegative() || accrual.IsZero() {
 		return fmt.Errorf("incorrect deposit amount")
 	}
 
-	u.Balance = u.Balance.Add(sum)
-
-	return nil
-}
-
-func (u *User) Deposit(ctx context.Context, orderID int64, accrual decimal.Decimal) error {
 	db := storage.GetDB()
 	db.Lock.Lock()
 	defer db.Lock.Unlock()
 
-	if err := u.deposit(accrual); err != nil {
-		return err
-	}
-
 	tx, err := db.Pool.Begin(ctx)
 	if err != nil {
 		return err
@@ -127,14 +179,30 @@ func (u *User) Deposit(ctx context.Context, orderID int64, accrual decimal.Decim
 		return err
 	}
 
-	userUpdateQuery := "UPDATE users SET balance = $1 WHERE id = $2"
-	if _, err = tx.Exec(ctx, userUpdateQuery, u.Balance, u.ID); err != nil {
+	if err = insertStatusChange(ctx, tx, orderID, Processed, source); err != nil {
+		return err
+	}
+
+	var balance decimal.Decimal
+	userUpdateQuery := "UPDATE users SET balance = balance + $1 WHERE id = $2 RETURNING balance"
+	if err = tx.QueryRow(ctx, userUpdateQuery, accrual, u.ID).Scan(&balance); err != nil {
+		return err
+	}
+
+	event := NewAuditEvent(AuditDeposit, 0, u.ID)
+	event.Details["order"] = orderID.String()
+	event.Details["accrual"] = accrual.String()
+	event.Details["source"] = source
+	event.Details["balance"] = balance.String()
+	if err = event.insert(ctx, tx); err != nil {
 		return err
 	}
 
 	if err := tx.Commit(ctx); err != nil {
 		return err
 	}
+
+	u.Balance = balance
 	return rollbackErr
 }
 
@@ -143,8 +211,7 @@ func (u *User) getFromDB(ctx context.Context, query string, lookup interface{})
 	db.Lock.RLock()
 	defer db.Lock.RUnlock()
 
-	fmt.Println(u)
-	err := db.Pool.QueryRow(ctx, query, lookup).Scan(&u.ID, &u.Balance, &u.Login, &u.password)
+	err := db.Pool.QueryRow(ctx, query, lookup).Scan(u.scanDest()...)
 	if err != nil {
 		return err
 	}
@@ -152,14 +219,23 @@ func (u *User) getFromDB(ctx context.Context, query string, lookup interface{})
 	return nil
 }
 
+func (u *User) scanDest() []interface{} {
+	return []interface{}{
+		&u.ID, &u.Balance, &u.Login, &u.password, &u.TOTPEnabled, &u.totpSecret, &u.Role, &u.Blocked,
+	}
+}
+
+const selectUserQuery = `SELECT id, balance, login, password,
+	coalesce(totp_enabled, false), coalesce(totp_secret, ''), role,
+	blocked_at IS NOT NULL
+	FROM users`
+
 func (u *User) GetByLogin(ctx context.Context, login string) error {
-	query := "SELECT id, balance, login, password FROM users WHERE login = $1"
-	return u.getFromDB(ctx, query, login)
+	return u.getFromDB(ctx, selectUserQuery+" WHERE login = $1", login)
 }
 
 func (u *User) GetByID(ctx context.Context, id int) error {
-	query := "SELECT id, balance, login, password FROM users WHERE id = $1"
-	return u.getFromDB(ctx, query, id)
+	return u.getFromDB(ctx, selectUserQuery+" WHERE id = $1", id)
 }
 
 func (u *User) Insert(ctx context.Context) error {
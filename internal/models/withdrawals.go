@@ -1,18 +1,21 @@
 package models
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"time"
 
 	"github.com/shopspring/decimal"
+
+	"github.com/kazauwa/gophermart/internal/storage"
+	"github.com/kazauwa/gophermart/internal/utils"
 )
 
 type Withdrawal struct {
-	ID          int             `json:"-"`
-	OrderID     int64           `json:"order"`
-	Sum         decimal.Decimal `json:"sum"`
-	ProcessedAt time.Time       `json:"processed_at"`
+	ID          int               `json:"-"`
+	OrderID     utils.OrderNumber `json:"order"`
+	Sum         decimal.Decimal   `json:"sum"`
+	ProcessedAt time.Time         `json:"processed_at"`
 }
 
 func NewWithdrawal() *Withdrawal {
@@ -26,8 +29,30 @@ func (w *Withdrawal) MarshalJSON() ([]byte, error) {
 		ProcessedAt string `json:"processed_at"`
 		*shadowWithdrawal
 	}{
-		OrderID:          fmt.Sprint(w.OrderID),
+		OrderID:          w.OrderID.String(),
 		ProcessedAt:      w.ProcessedAt.Format(time.RFC3339),
 		shadowWithdrawal: (*shadowWithdrawal)(w),
 	})
 }
+
+func (w *Withdrawal) GetByOrderID(
+	ctx context.Context,
+	orderID utils.OrderNumber,
+	userID int,
+) error {
+	db := storage.GetDB()
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	query := `SELECT id, order_id, amount, processed_at
+		FROM withdrawals
+		WHERE order_id = $1 AND user_id = $2`
+	err := db.Pool.QueryRow(ctx, query, orderID, userID).Scan(
+		&w.ID, &w.OrderID, &w.Sum, &w.ProcessedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
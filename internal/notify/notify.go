@@ -0,0 +1,64 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type Message struct {
+	Recipient string    `json:"recipient"`
+	Subject   string    `json:"subject"`
+	Body      string    `json:"body"`
+	SentAt    time.Time `json:"sent_at"`
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, message *Message) error
+}
+
+type LogNotifier struct{}
+
+func NewLogNotifier() *LogNotifier {
+	return &LogNotifier{}
+}
+
+// Notify logs that a message was sent. The body is left out, since it may
+// carry secrets such as password reset tokens; use FileNotifier to read it.
+func (n *LogNotifier) Notify(ctx context.Context, message *Message) error {
+	log.Info().
+		Str("recipient", message.Recipient).
+		Str("subject", message.Subject).
+		Int("body_length", len(message.Body)).
+		Msg("notification")
+	return nil
+}
+
+type FileNotifier struct {
+	path string
+	lock sync.Mutex
+}
+
+func NewFileNotifier(path string) *FileNotifier {
+	return &FileNotifier{path: path}
+}
+
+func (n *FileNotifier) Notify(ctx context.Context, message *Message) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	file, err := os.OpenFile(n.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if message.SentAt.IsZero() {
+		message.SentAt = time.Now()
+	}
+	return json.NewEncoder(file).Encode(message)
+}
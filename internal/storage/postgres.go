@@ -9,6 +9,8 @@ import (
 	shopspring "github.com/jackc/pgtype/ext/shopspring-numeric"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+
+	"github.com/kazauwa/gophermart/internal/tracing"
 )
 
 type Postgres struct {
@@ -26,7 +28,7 @@ const (
 		balance numeric DEFAULT 0.00
 	);`
 	createOrdersTableQuery string = `CREATE TABLE IF NOT EXISTS orders(
-		id bigint PRIMARY KEY,
+		id text PRIMARY KEY,
 		user_id int REFERENCES users(id),
 		status text DEFAULT 'NEW',
 		accrual numeric DEFAULT 0.00,
@@ -35,18 +37,200 @@ const (
 	createWithdrawalsTableQuery string = `CREATE TABLE IF NOT EXISTS withdrawals(
 		id int generated by default as identity PRIMARY KEY,
 		user_id int REFERENCES users(id),
-		order_id bigint UNIQUE,
+		order_id text UNIQUE,
 		amount numeric DEFAULT 0.00,
 		processed_at timestamptz DEFAULT CURRENT_TIMESTAMP
 	);`
+	// The foreign key to orders is added by the first migration, once
+	// orders.id has been converted to text on databases created before that.
+	createOrderStatusHistoryTableQuery string = `CREATE TABLE IF NOT EXISTS order_status_history(
+		id int generated by default as identity PRIMARY KEY,
+		order_id text,
+		status text NOT NULL,
+		source text NOT NULL,
+		changed_at timestamptz DEFAULT CURRENT_TIMESTAMP
+	);`
+	createIdempotencyKeysTableQuery string = `CREATE TABLE IF NOT EXISTS idempotency_keys(
+		user_id int REFERENCES users(id),
+		key varchar(255) NOT NULL,
+		request_hash varchar(64) NOT NULL,
+		status_code int,
+		content_type text,
+		response bytea,
+		created_at timestamptz DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, key)
+	);
+	CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON idempotency_keys (created_at);`
+	createRefreshTokensTableQuery string = `CREATE TABLE IF NOT EXISTS refresh_tokens(
+		id int generated by default as identity PRIMARY KEY,
+		user_id int REFERENCES users(id),
+		token_hash varchar(64) UNIQUE NOT NULL,
+		expires_at timestamptz NOT NULL,
+		revoked_at timestamptz,
+		created_at timestamptz DEFAULT CURRENT_TIMESTAMP
+	);`
+	createUserSessionsTableQuery string = `CREATE TABLE IF NOT EXISTS user_sessions(
+		id int generated by default as identity PRIMARY KEY,
+		user_id int REFERENCES users(id),
+		token_hash varchar(64) UNIQUE NOT NULL,
+		user_agent text,
+		ip text,
+		created_at timestamptz DEFAULT CURRENT_TIMESTAMP,
+		last_seen_at timestamptz DEFAULT CURRENT_TIMESTAMP,
+		revoked_at timestamptz
+	);`
+	createPasswordResetTokensTableQuery string = `CREATE TABLE IF NOT EXISTS password_reset_tokens(
+		id int generated by default as identity PRIMARY KEY,
+		user_id int REFERENCES users(id),
+		token_hash varchar(64) UNIQUE NOT NULL,
+		expires_at timestamptz NOT NULL,
+		used_at timestamptz,
+		created_at timestamptz DEFAULT CURRENT_TIMESTAMP
+	);`
+	createRecoveryCodesTableQuery string = `CREATE TABLE IF NOT EXISTS recovery_codes(
+		id int generated by default as identity PRIMARY KEY,
+		user_id int REFERENCES users(id),
+		code_hash varchar(64) NOT NULL,
+		used_at timestamptz
+	);`
+	createLoginChallengesTableQuery string = `CREATE TABLE IF NOT EXISTS login_challenges(
+		id int generated by default as identity PRIMARY KEY,
+		user_id int REFERENCES users(id),
+		token_hash varchar(64) UNIQUE NOT NULL,
+		issue_tokens boolean DEFAULT false,
+		attempts int DEFAULT 0,
+		expires_at timestamptz NOT NULL,
+		used_at timestamptz
+	);`
+	createBalanceAdjustmentsTableQuery string = `CREATE TABLE IF NOT EXISTS balance_adjustments(
+		id int generated by default as identity PRIMARY KEY,
+		user_id int REFERENCES users(id),
+		actor_id int REFERENCES users(id),
+		amount numeric NOT NULL,
+		reason text NOT NULL,
+		created_at timestamptz DEFAULT CURRENT_TIMESTAMP
+	);`
+	createAuditEventsTableQuery string = `CREATE TABLE IF NOT EXISTS audit_events(
+		id bigint generated by default as identity PRIMARY KEY,
+		actor_id int REFERENCES users(id),
+		user_id int REFERENCES users(id),
+		action text NOT NULL,
+		details jsonb,
+		created_at timestamptz DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS audit_events_user_id_created_at_idx ON audit_events (user_id, created_at);`
+	createPartnersTableQuery string = `CREATE TABLE IF NOT EXISTS partners(
+		id int generated by default as identity PRIMARY KEY,
+		name varchar(128) unique NOT NULL,
+		created_at timestamptz DEFAULT CURRENT_TIMESTAMP
+	);`
+	createPartnerAPIKeysTableQuery string = `CREATE TABLE IF NOT EXISTS partner_api_keys(
+		id int generated by default as identity PRIMARY KEY,
+		partner_id int REFERENCES partners(id),
+		prefix varchar(16) UNIQUE NOT NULL,
+		key_hash varchar(64) NOT NULL,
+		scopes text[] NOT NULL DEFAULT '{}',
+		created_at timestamptz DEFAULT CURRENT_TIMESTAMP,
+		last_used_at timestamptz,
+		revoked_at timestamptz
+	);`
+	createPartnerCustomersTableQuery string = `CREATE TABLE IF NOT EXISTS partner_customers(
+		partner_id int REFERENCES partners(id),
+		external_id varchar(255) NOT NULL,
+		user_id int REFERENCES users(id),
+		created_at timestamptz DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (partner_id, external_id)
+	);`
+	createUserIdentitiesTableQuery string = `CREATE TABLE IF NOT EXISTS user_identities(
+		issuer text NOT NULL,
+		subject text NOT NULL,
+		user_id int REFERENCES users(id),
+		created_at timestamptz DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (issuer, subject)
+	);`
+	createPartnerLinkTokensTableQuery string = `CREATE TABLE IF NOT EXISTS partner_link_tokens(
+		id int generated by default as identity PRIMARY KEY,
+		partner_id int REFERENCES partners(id),
+		user_id int REFERENCES users(id),
+		token_hash varchar(64) UNIQUE NOT NULL,
+		expires_at timestamptz NOT NULL,
+		used_at timestamptz,
+		created_at timestamptz DEFAULT CURRENT_TIMESTAMP
+	);`
+	createSchemaMigrationsTableQuery string = `CREATE TABLE IF NOT EXISTS schema_migrations(
+		version int PRIMARY KEY,
+		applied_at timestamptz DEFAULT CURRENT_TIMESTAMP
+	);`
 )
 
+var migrations = []string{
+	`ALTER TABLE order_status_history DROP CONSTRAINT IF EXISTS order_status_history_order_id_fkey;
+	ALTER TABLE orders ALTER COLUMN id TYPE text USING id::text;
+	ALTER TABLE order_status_history ALTER COLUMN order_id TYPE text USING order_id::text;
+	ALTER TABLE order_status_history ADD CONSTRAINT order_status_history_order_id_fkey
+		FOREIGN KEY (order_id) REFERENCES orders(id);
+	ALTER TABLE withdrawals ALTER COLUMN order_id TYPE text USING order_id::text;`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret text;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled boolean DEFAULT false;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step bigint DEFAULT 0;`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS role text NOT NULL DEFAULT 'user'
+		CHECK (role IN ('user', 'support', 'admin'));`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS blocked_at timestamptz;`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at timestamptz;`,
+	`ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS ip text;
+	ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS user_agent text;
+	CREATE INDEX IF NOT EXISTS audit_events_created_at_idx ON audit_events (created_at);
+	CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'audit_events is append-only';
+	END;
+	$$ LANGUAGE plpgsql;
+	CREATE TRIGGER audit_events_append_only
+		BEFORE UPDATE OR DELETE ON audit_events
+		FOR EACH ROW EXECUTE PROCEDURE audit_events_append_only();`,
+	`UPDATE orders SET status = 'INVALID' WHERE status = 'FAILED';
+	UPDATE order_status_history SET status = 'INVALID' WHERE status = 'FAILED';
+	INSERT INTO order_status_history (order_id, status, source, changed_at)
+		SELECT o.id, o.status, 'migration', o.uploaded_at
+		FROM orders o
+		WHERE NOT EXISTS (SELECT 1 FROM order_status_history h WHERE h.order_id = o.id);`,
+	`ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS locked_until timestamptz;`,
+	`ALTER TABLE user_sessions ADD COLUMN IF NOT EXISTS expires_at timestamptz;`,
+	`ALTER TABLE login_challenges ADD COLUMN IF NOT EXISTS password_rehash text;`,
+	`CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP = 'UPDATE' AND current_setting('gophermart.audit_scrub', true) = 'on'
+			AND NEW.id = OLD.id
+			AND NEW.action = OLD.action
+			AND NEW.actor_id IS NOT DISTINCT FROM OLD.actor_id
+			AND NEW.user_id IS NOT DISTINCT FROM OLD.user_id
+			AND NEW.created_at IS NOT DISTINCT FROM OLD.created_at
+			AND (NEW.ip IS NULL OR NEW.ip = OLD.ip)
+			AND (NEW.user_agent IS NULL OR NEW.user_agent = OLD.user_agent)
+			AND (NEW.details IS NOT DISTINCT FROM OLD.details OR NEW.details = OLD.details - 'login') THEN
+			RETURN NEW;
+		END IF;
+		RAISE EXCEPTION 'audit_events is append-only';
+	END;
+	$$ LANGUAGE plpgsql;
+	SET LOCAL gophermart.audit_scrub = 'on';
+	UPDATE audit_events SET details = details - 'login'
+		WHERE user_id IS NOT NULL AND details ? 'login';`,
+}
+
 func NewPostgres(ctx context.Context, dsn string) error {
 	if db != nil {
 		return fmt.Errorf("DB connection already exists")
 	}
 
-	pool, err := pgxpool.Connect(ctx, dsn)
+	config, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return err
+	}
+	config.ConnConfig.Logger = tracing.NewQueryLogger()
+	config.ConnConfig.LogLevel = pgx.LogLevelInfo
+
+	pool, err := pgxpool.ConnectConfig(ctx, config)
 	if err != nil {
 		return err
 	}
@@ -76,6 +260,13 @@ func GetDB() *Postgres {
 	return db
 }
 
+// Close waits for acquired connections to be released and closes the pool.
+func Close() {
+	if db != nil {
+		db.Pool.Close()
+	}
+}
+
 func (p *Postgres) initDB(ctx context.Context, pool *pgxpool.Pool) error {
 	if _, err := pool.Exec(ctx, createUsersTableQuery); err != nil {
 		return err
@@ -89,5 +280,126 @@ func (p *Postgres) initDB(ctx context.Context, pool *pgxpool.Pool) error {
 		return err
 	}
 
+	if _, err := pool.Exec(ctx, createOrderStatusHistoryTableQuery); err != nil {
+		return err
+	}
+
+	if _, err := pool.Exec(ctx, createIdempotencyKeysTableQuery); err != nil {
+		return err
+	}
+
+	if _, err := pool.Exec(ctx, createRefreshTokensTableQuery); err != nil {
+		return err
+	}
+
+	if _, err := pool.Exec(ctx, createUserSessionsTableQuery); err != nil {
+		return err
+	}
+
+	if _, err := pool.Exec(ctx, createPasswordResetTokensTableQuery); err != nil {
+		return err
+	}
+
+	if _, err := pool.Exec(ctx, createRecoveryCodesTableQuery); err != nil {
+		return err
+	}
+
+	if _, err := pool.Exec(ctx, createLoginChallengesTableQuery); err != nil {
+		return err
+	}
+
+	if _, err := pool.Exec(ctx, createBalanceAdjustmentsTableQuery); err != nil {
+		return err
+	}
+
+	if _, err := pool.Exec(ctx, createAuditEventsTableQuery); err != nil {
+		return err
+	}
+
+	if _, err := pool.Exec(ctx, createPartnersTableQuery); err != nil {
+		return err
+	}
+
+	if _, err := pool.Exec(ctx, createPartnerAPIKeysTableQuery); err != nil {
+		return err
+	}
+
+	if _, err := pool.Exec(ctx, createPartnerCustomersTableQuery); err != nil {
+		return err
+	}
+
+	if _, err := pool.Exec(ctx, createUserIdentitiesTableQuery); err != nil {
+		return err
+	}
+
+	if _, err := pool.Exec(ctx, createPartnerLinkTokensTableQuery); err != nil {
+		return err
+	}
+
+	return p.migrate(ctx, pool)
+}
+
+func (p *Postgres) migrate(ctx context.Context, pool *pgxpool.Pool) error {
+	if _, err := pool.Exec(ctx, createSchemaMigrationsTableQuery); err != nil {
+		return err
+	}
+
+	currentVersion, err := schemaVersion(ctx, pool)
+	if err != nil {
+		return err
+	}
+
+	for i := currentVersion; i < len(migrations); i++ {
+		if err := applyMigration(ctx, pool, i+1, migrations[i]); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+	}
 	return nil
 }
+
+// PendingMigrations reports how many known migrations have not been applied
+// to the database yet.
+func (p *Postgres) PendingMigrations(ctx context.Context) (int, error) {
+	currentVersion, err := schemaVersion(ctx, p.Pool)
+	if err != nil {
+		return 0, err
+	}
+	if currentVersion >= len(migrations) {
+		return 0, nil
+	}
+	return len(migrations) - currentVersion, nil
+}
+
+func schemaVersion(ctx context.Context, pool *pgxpool.Pool) (int, error) {
+	var version int
+	err := pool.QueryRow(
+		ctx,
+		"SELECT coalesce(max(version), 0) FROM schema_migrations",
+	).Scan(&version)
+	return version, err
+}
+
+func applyMigration(ctx context.Context, pool *pgxpool.Pool, version int, query string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	var rollbackErr error
+	defer func() {
+		rollbackErr = tx.Rollback(ctx)
+	}()
+
+	if _, err = tx.Exec(ctx, query); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", version); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	return rollbackErr
+}
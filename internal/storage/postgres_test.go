@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// baselineSchema is the schema created by the first release, before order
+// numbers were stored as text.
+var baselineSchema = []string{
+	`CREATE TABLE users(
+		id int generated by default as identity PRIMARY KEY,
+		login varchar(64) unique NOT NULL,
+		password varchar(128) NOT NULL,
+		balance numeric DEFAULT 0.00
+	);`,
+	`CREATE TABLE orders(
+		id bigint PRIMARY KEY,
+		user_id int REFERENCES users(id),
+		status text DEFAULT 'NEW',
+		accrual numeric DEFAULT 0.00,
+		uploaded_at timestamptz DEFAULT CURRENT_TIMESTAMP
+	);`,
+	`CREATE TABLE withdrawals(
+		id int generated by default as identity PRIMARY KEY,
+		user_id int REFERENCES users(id),
+		order_id bigint UNIQUE,
+		amount numeric DEFAULT 0.00,
+		processed_at timestamptz DEFAULT CURRENT_TIMESTAMP
+	);`,
+}
+
+// newTestPool connects to TEST_DATABASE_URI with a schema of its own that is
+// dropped when the test ends. Tests are skipped when the variable is unset.
+func newTestPool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URI")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URI is not set")
+	}
+
+	ctx := context.Background()
+	admin, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close(ctx)
+
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn, err := pgx.Connect(ctx, dsn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(ctx)
+		if _, err := conn.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	config, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ConnConfig.RuntimeParams["search_path"] = schema
+
+	pool, err := pgxpool.ConnectConfig(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+func TestInitDBUpgradesBaselineSchema(t *testing.T) {
+	pool := newTestPool(t)
+	ctx := context.Background()
+
+	for _, query := range baselineSchema {
+		if _, err := pool.Exec(ctx, query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seed := []string{
+		"INSERT INTO users (id, login, password) VALUES (1, 'gopher', 'hash')",
+		"INSERT INTO orders (id, user_id, status) VALUES (12345678903, 1, 'PROCESSED')",
+		"INSERT INTO withdrawals (user_id, order_id, amount) VALUES (1, 2377225624, 10)",
+	}
+	for _, query := range seed {
+		if _, err := pool.Exec(ctx, query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	postgres := &Postgres{Pool: pool}
+	if err := postgres.initDB(ctx, pool); err != nil {
+		t.Fatalf("initDB on the baseline schema: %v", err)
+	}
+
+	pending, err := postgres.PendingMigrations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending != 0 {
+		t.Errorf("got %d pending migrations, want 0", pending)
+	}
+
+	var orderID string
+	if err := pool.QueryRow(ctx, "SELECT id FROM orders").Scan(&orderID); err != nil {
+		t.Fatal(err)
+	}
+	if orderID != "12345678903" {
+		t.Errorf("got order id %q, want %q", orderID, "12345678903")
+	}
+
+	// The backfilled history must reference the converted order.
+	var status string
+	err = pool.QueryRow(ctx, "SELECT status FROM order_status_history WHERE order_id = $1", orderID).Scan(&status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "PROCESSED" {
+		t.Errorf("got history status %q, want %q", status, "PROCESSED")
+	}
+
+	_, err = pool.Exec(ctx, "INSERT INTO order_status_history (order_id, status, source) VALUES ('missing', 'NEW', 'test')")
+	if err == nil {
+		t.Error("order_status_history accepted an unknown order: foreign key is missing")
+	}
+
+	// Running it again on an up-to-date schema must be a no-op.
+	if err := postgres.initDB(ctx, pool); err != nil {
+		t.Fatalf("initDB on an up-to-date schema: %v", err)
+	}
+}
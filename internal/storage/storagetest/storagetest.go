@@ -0,0 +1,78 @@
+// Package storagetest runs package tests against a throwaway schema in the
+// database named by TEST_DATABASE_URI.
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/kazauwa/gophermart/internal/storage"
+)
+
+const dsnVariable = "TEST_DATABASE_URI"
+
+// Run is meant to be called from TestMain. It points the storage at a schema
+// of its own, runs the tests and drops the schema. Without TEST_DATABASE_URI
+// the tests run without a database and Require skips them.
+func Run(m *testing.M) int {
+	dsn := os.Getenv(dsnVariable)
+	if dsn == "" {
+		return m.Run()
+	}
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer conn.Close(ctx)
+
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	if _, err := conn.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer func() {
+		if _, err := conn.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE"); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+
+	if err := storage.NewPostgres(ctx, withSearchPath(dsn, schema)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer storage.Close()
+	return m.Run()
+}
+
+// Require skips the test when no database is configured.
+func Require(t *testing.T) {
+	t.Helper()
+	if storage.GetDB() == nil {
+		t.Skip(dsnVariable + " is not set")
+	}
+}
+
+func withSearchPath(dsn, schema string) string {
+	if !strings.Contains(dsn, "://") {
+		return dsn + " search_path=" + schema
+	}
+
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		return dsn
+	}
+	query := parsed.Query()
+	query.Set("search_path", schema)
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
@@ -0,0 +1,83 @@
+package tokens
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+type KeySet struct {
+	keys       map[string][]byte
+	signingKID string
+	accessTTL  time.Duration
+}
+
+func NewKeySet(keys map[string]string, signingKID string, accessTTL time.Duration) (*KeySet, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("key set is empty")
+	}
+
+	keySet := &KeySet{
+		keys:       make(map[string][]byte, len(keys)),
+		signingKID: signingKID,
+		accessTTL:  accessTTL,
+	}
+	for kid, secret := range keys {
+		if secret == "" {
+			return nil, fmt.Errorf("empty secret for key %q", kid)
+		}
+		keySet.keys[kid] = []byte(secret)
+	}
+
+	if _, ok := keySet.keys[signingKID]; !ok {
+		return nil, fmt.Errorf("signing key %q is not in the key set", signingKID)
+	}
+	return keySet, nil
+}
+
+func (k *KeySet) AccessTTL() time.Duration {
+	return k.accessTTL
+}
+
+func (k *KeySet) IssueAccessToken(userID int) (string, error) {
+	now := time.Now()
+	claims := jwt.RegisteredClaims{
+		Subject:   strconv.Itoa(userID),
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(k.accessTTL)),
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = k.signingKID
+	return token.SignedString(k.keys[k.signingKID])
+}
+
+func (k *KeySet) ParseAccessToken(tokenString string) (int, error) {
+	var claims jwt.RegisteredClaims
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, ErrInvalidToken
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		key, ok := k.keys[kid]
+		if !ok {
+			return nil, ErrInvalidToken
+		}
+		return key, nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, ErrInvalidToken
+	}
+	return userID, nil
+}
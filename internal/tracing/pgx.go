@@ -0,0 +1,53 @@
+package tracing
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// QueryLogger turns pgx query log entries into spans. pgx v4 only reports a
+// query once it has finished, so the span start is derived from the reported
+// duration.
+type QueryLogger struct{}
+
+func NewQueryLogger() *QueryLogger {
+	return &QueryLogger{}
+}
+
+func (l *QueryLogger) Log(ctx context.Context, level pgx.LogLevel, msg string, data map[string]interface{}) {
+	elapsed, ok := data["time"].(time.Duration)
+	if !ok {
+		return
+	}
+
+	end := time.Now()
+	attrs := []attribute.KeyValue{
+		semconv.DBSystemPostgreSQL,
+		attribute.String("db.operation", msg),
+	}
+	if sql, ok := data["sql"].(string); ok {
+		attrs = append(attrs, semconv.DBStatementKey.String(sql))
+	}
+	if rows, ok := data["rowCount"].(int); ok {
+		attrs = append(attrs, attribute.Int("db.row_count", rows))
+	}
+
+	_, span := Tracer().Start(
+		ctx,
+		"db."+msg,
+		trace.WithTimestamp(end.Add(-elapsed)),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+	if err, ok := data["err"].(error); ok {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(trace.WithTimestamp(end))
+}
@@ -36,20 +36,20 @@ func (e *RateLimitedError) Error() string {
 }
 
 type OrderDoesNotExistError struct {
-	OrderID int64
+	OrderID OrderNumber
 }
 
 func (e *OrderDoesNotExistError) Error() string {
-	return fmt.Sprintf("order %d does not exist", e.OrderID)
+	return fmt.Sprintf("order %s does not exist", e.OrderID)
 }
 
 func makeRequest(
 	ctx context.Context,
 	accrualAddress string,
 	client *http.Client,
-	orderID int64,
+	orderID OrderNumber,
 ) (*http.Response, error) {
-	url := fmt.Sprintf("%s/api/orders/%d", accrualAddress, orderID)
+	url := fmt.Sprintf("%s/api/orders/%s", accrualAddress, orderID)
 	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
@@ -66,7 +66,7 @@ func GetOrderInfo(
 	ctx context.Context,
 	accrualAddress string,
 	client *http.Client,
-	orderID int64,
+	orderID OrderNumber,
 ) (*OrderInfo, error) {
 	response, err := makeRequest(ctx, accrualAddress, client, orderID)
 	if err != nil {
@@ -100,10 +100,10 @@ func GetOrderInfo(
 		return &orderInfo, nil
 	}
 
-	log.Error().Caller().Int(
+	log.Ctx(ctx).Error().Caller().Int(
 		"status_code", response.StatusCode,
-	).Int64(
-		"order_id", orderID,
+	).Str(
+		"order_id", orderID.String(),
 	).Msg("unkown reponse from accrual")
 	return nil, fmt.Errorf("unkown response")
 }
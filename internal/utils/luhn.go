@@ -1,24 +1,25 @@
 package utils
 
-func IsValidLuhn(number int64) bool {
-	return (number%10+checksum(number/10))%10 == 0
-}
-
-func checksum(number int64) int64 {
-	var luhn int64
+func IsValidLuhn(number string) bool {
+	if number == "" {
+		return false
+	}
 
-	for i := 0; number > 0; i++ {
-		digit := number % 10
+	var luhn int
+	parity := len(number) % 2
+	for i, char := range number {
+		if char < '0' || char > '9' {
+			return false
+		}
 
-		if i%2 == 0 {
+		digit := int(char - '0')
+		if i%2 == parity {
 			digit = digit * 2
 			if digit > 9 {
 				digit = digit%10 + digit/10
 			}
 		}
-
 		luhn += digit
-		number = number / 10
 	}
-	return luhn % 10
+	return luhn%10 == 0
 }
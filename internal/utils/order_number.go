@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrMalformedOrderNumber = errors.New("order number must contain only digits")
+
+type OrderNumber string
+
+func ParseOrderNumber(raw string) (OrderNumber, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", ErrMalformedOrderNumber
+	}
+
+	for _, char := range raw {
+		if char < '0' || char > '9' {
+			return "", ErrMalformedOrderNumber
+		}
+	}
+	return OrderNumber(raw), nil
+}
+
+func (n OrderNumber) IsValidLuhn() bool {
+	return IsValidLuhn(string(n))
+}
+
+func (n OrderNumber) String() string {
+	return string(n)
+}